@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"os/signal"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -32,13 +33,28 @@ func action(ctx *cli.Context, sigs <-chan os.Signal) error {
 		}
 	}()
 
-	select {
-	case <-sigs:
-		log.Info("shutdown signal triggered")
-	case err := <-errs:
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Error("server error triggered")
+loop:
+	for {
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				log.Info("reload signal triggered")
+				if err := c.Reload(); err != nil {
+					log.WithFields(log.Fields{
+						"error": err,
+					}).Error("error reloading, keeping the previous certificates")
+				}
+				continue
+			}
+
+			log.Info("shutdown signal triggered")
+			break loop
+		case err := <-errs:
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("server error triggered")
+			break loop
+		}
 	}
 
 	if err := c.Stop(); err != nil {
@@ -85,6 +101,59 @@ func newApp() *cli.App {
 			Value:  "6379",
 			EnvVar: "REDIS_PORT",
 		},
+		cli.StringFlag{
+			Name:   "redis-username",
+			Usage:  "ACL username used to authenticate with redis",
+			EnvVar: "REDIS_USERNAME",
+		},
+		cli.StringFlag{
+			Name:   "redis-password",
+			Usage:  "password used to authenticate with redis, prefer the env var or --redis-password-file",
+			EnvVar: "REDIS_PASSWORD",
+		},
+		cli.StringFlag{
+			Name:   "redis-password-file",
+			Usage:  "file containing the password used to authenticate with redis",
+			EnvVar: "REDIS_PASSWORD_FILE",
+		},
+		cli.IntFlag{
+			Name:   "redis-db",
+			Usage:  "redis database to select",
+			EnvVar: "REDIS_DB",
+		},
+		cli.IntFlag{
+			Name:  "redis-databases",
+			Usage: "number of databases of redis, SELECT of others is refused",
+			Value: 16,
+		},
+		cli.BoolFlag{
+			Name:   "redis-tls",
+			Usage:  "connect to redis using TLS",
+			EnvVar: "REDIS_TLS",
+		},
+		cli.StringFlag{
+			Name:   "redis-tls-ca-cert-file",
+			Usage:  "CA bundle used to verify the redis server certificate",
+			EnvVar: "REDIS_TLS_CA_CERT_FILE",
+		},
+		cli.StringFlag{
+			Name:   "redis-tls-cert-file",
+			Usage:  "client certificate presented to redis",
+			EnvVar: "REDIS_TLS_CERT_FILE",
+		},
+		cli.StringFlag{
+			Name:   "redis-tls-key-file",
+			Usage:  "private key of the client certificate presented to redis",
+			EnvVar: "REDIS_TLS_KEY_FILE",
+		},
+		cli.StringFlag{
+			Name:  "redis-tls-server-name",
+			Usage: "server name used to verify the redis certificate, defaults to --redis-host",
+		},
+		cli.BoolFlag{
+			Name:  "redis-tls-insecure-skip-verify",
+			Usage: "don't verify the redis server certificate, for development only",
+		},
 		cli.StringFlag{
 			Name:   "redis-server-port",
 			Usage:  "port for the redis proxy server to listen on",
@@ -98,7 +167,7 @@ func newApp() *cli.App {
 		},
 		cli.UintFlag{
 			Name:  "concurrency,C",
-			Usage: "max number of concurrent clients",
+			Usage: "max number of concurrent requests, each HTTP/2 stream counting as one",
 			Value: 30,
 		},
 		cli.StringFlag{
@@ -111,6 +180,151 @@ func newApp() *cli.App {
 			Usage: "HTTP server port",
 			Value: "3000",
 		},
+		cli.StringFlag{
+			Name:   "users-file",
+			Usage:  "JSON file with the users and ACLs allowed to use the proxy, disables anonymous access",
+			EnvVar: "USERS_FILE",
+		},
+		cli.StringFlag{
+			Name:   "tls-cert-file",
+			Usage:  "certificate used to serve TLS on the HTTP and redis listeners, reloaded on SIGHUP",
+			EnvVar: "TLS_CERT_FILE",
+		},
+		cli.StringFlag{
+			Name:   "tls-key-file",
+			Usage:  "private key of the TLS certificate",
+			EnvVar: "TLS_KEY_FILE",
+		},
+		cli.StringFlag{
+			Name:   "tls-ca-cert-file",
+			Usage:  "CA bundle used to verify client certificates",
+			EnvVar: "TLS_CA_CERT_FILE",
+		},
+		cli.StringFlag{
+			Name:  "tls-auth-clients",
+			Usage: "whether clients must present a certificate signed by the CA: no, optional or yes",
+			Value: "yes",
+		},
+		cli.StringFlag{
+			Name:  "request-timeout",
+			Usage: "max time a request can spend queued and querying redis, 0 disables it",
+			Value: "5s",
+		},
+		cli.StringFlag{
+			Name:  "cacheable-scripts",
+			Usage: "comma separated SHAs of read only Lua scripts whose results are cached, each optionally followed by a ttl, e.g. sha:30s",
+		},
+		cli.IntFlag{
+			Name:  "pubsub-connections",
+			Usage: "number of upstream connections shared by subscribed clients",
+			Value: 2,
+		},
+		cli.IntFlag{
+			Name:  "pubsub-client-buffer",
+			Usage: "max number of messages queued for a subscribed client before it's disconnected",
+			Value: 1024,
+		},
+		cli.IntFlag{
+			Name:  "max-transactions",
+			Usage: "max number of clients in a transaction at once, each holding an upstream connection",
+			Value: 64,
+		},
+		cli.StringFlag{
+			Name:  "watch-heartbeat",
+			Usage: "how often idle clients of /watch are sent a heartbeat",
+			Value: "15s",
+		},
+		cli.IntFlag{
+			Name:  "watch-buffer",
+			Usage: "number of events kept for clients of /watch to resume from",
+			Value: 1024,
+		},
+		cli.IntFlag{
+			Name:  "watch-max-clients",
+			Usage: "max number of clients watching keys",
+			Value: 1000,
+		},
+		cli.IntFlag{
+			Name:  "watch-max-keys",
+			Usage: "max number of keys and patterns watched by a single client",
+			Value: 100,
+		},
+		cli.BoolFlag{
+			Name:  "h2c",
+			Usage: "serve HTTP/2 without TLS to clients with prior knowledge or upgrading with Upgrade: h2c",
+		},
+		cli.BoolFlag{
+			Name:  "keyspace-notifications",
+			Usage: "invalidate the cache and notify watchers of the keys changed by other redis clients, requires notify-keyspace-events",
+		},
+		cli.IntFlag{
+			Name:  "max-batch-size",
+			Usage: "max number of keys fetched by a single request to /mget",
+			Value: 1000,
+		},
+		cli.StringFlag{
+			Name:  "content-types",
+			Usage: "comma separated content types of the values of keys matching a pattern over HTTP, e.g. user:*=application/json",
+		},
+		cli.IntFlag{
+			Name:  "compress-min-size",
+			Usage: "size in bytes from which HTTP replies are compressed, -1 disables compression",
+			Value: 1024,
+		},
+		cli.StringFlag{
+			Name:  "health-check-interval",
+			Usage: "how often redis is pinged to check the proxy is ready",
+			Value: "1s",
+		},
+		cli.StringFlag{
+			Name:  "redis-dial-timeout",
+			Usage: "timeout for establishing new connections to redis",
+			Value: "5s",
+		},
+		cli.StringFlag{
+			Name:  "redis-read-timeout",
+			Usage: "timeout for socket reads from redis",
+			Value: "3s",
+		},
+		cli.StringFlag{
+			Name:  "redis-write-timeout",
+			Usage: "timeout for socket writes to redis",
+			Value: "3s",
+		},
+		cli.IntFlag{
+			Name:  "redis-pool-size",
+			Usage: "max number of connections to redis per worker, 0 uses 10 per CPU",
+		},
+		cli.StringFlag{
+			Name:  "redis-pool-timeout",
+			Usage: "time to wait for a free connection when the pool is busy",
+			Value: "4s",
+		},
+		cli.StringFlag{
+			Name:  "redis-idle-timeout",
+			Usage: "time after which idle connections to redis are closed",
+			Value: "5m",
+		},
+		cli.StringFlag{
+			Name:  "redis-idle-check-frequency",
+			Usage: "how often idle connections are reaped",
+			Value: "1m",
+		},
+		cli.IntFlag{
+			Name:  "redis-max-retries",
+			Usage: "max number of retries for reads failing with a network error",
+			Value: 2,
+		},
+		cli.StringFlag{
+			Name:  "redis-min-retry-backoff",
+			Usage: "min backoff between retries",
+			Value: "8ms",
+		},
+		cli.StringFlag{
+			Name:  "redis-max-retry-backoff",
+			Usage: "max backoff between retries",
+			Value: "512ms",
+		},
 	}
 
 	return app
@@ -118,7 +332,7 @@ func newApp() *cli.App {
 
 func handleSignal(fn func(ctx *cli.Context, sigs <-chan os.Signal) error) cli.ActionFunc {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Kill, os.Interrupt)
+	signal.Notify(sigs, os.Kill, os.Interrupt, syscall.SIGHUP)
 
 	return func(ctx *cli.Context) error {
 		defer close(sigs)
@@ -2,7 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/jeloou/rp/proxy"
@@ -23,6 +30,10 @@ func (c *command) Run() error {
 	return nil
 }
 
+func (c *command) Reload() error {
+	return c.dispatcher.Reload()
+}
+
 func (c *command) Stop() error {
 	ctx, cancel := context.WithTimeout(context.Background(), c.shutdownTimeout)
 	defer cancel()
@@ -48,7 +59,12 @@ func newCommand(ctx *cli.Context, errs chan<- error) (*command, error) {
 		return nil, err
 	}
 
-	d, err := proxy.NewDispatcher(port, redisAddr, redisServerPort, concurrency, workers, cacheCap, exp, errs)
+	opts, err := newOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := proxy.NewDispatcher(port, redisAddr, redisServerPort, concurrency, workers, cacheCap, exp, opts, errs)
 	if err != nil {
 		return nil, err
 	}
@@ -58,3 +74,161 @@ func newCommand(ctx *cli.Context, errs chan<- error) (*command, error) {
 		dispatcher:      d,
 	}, nil
 }
+
+func newOptions(ctx *cli.Context) (proxy.Options, error) {
+	var opts proxy.Options
+	var err error
+
+	durations := []struct {
+		flag string
+		dst  *time.Duration
+	}{
+		{"request-timeout", &opts.RequestTimeout},
+		{"health-check-interval", &opts.HealthCheckInterval},
+		{"watch-heartbeat", &opts.WatchHeartbeat},
+		{"redis-dial-timeout", &opts.Upstream.DialTimeout},
+		{"redis-read-timeout", &opts.Upstream.ReadTimeout},
+		{"redis-write-timeout", &opts.Upstream.WriteTimeout},
+		{"redis-pool-timeout", &opts.Upstream.PoolTimeout},
+		{"redis-idle-timeout", &opts.Upstream.IdleTimeout},
+		{"redis-idle-check-frequency", &opts.Upstream.IdleCheckFrequency},
+		{"redis-min-retry-backoff", &opts.Upstream.MinRetryBackoff},
+		{"redis-max-retry-backoff", &opts.Upstream.MaxRetryBackoff},
+	}
+
+	for _, d := range durations {
+		*d.dst, err = time.ParseDuration(ctx.GlobalString(d.flag))
+		if err != nil {
+			return opts, fmt.Errorf("invalid value for --%s: %v", d.flag, err)
+		}
+	}
+
+	opts.UsersFile = ctx.GlobalString("users-file")
+
+	exp, err := time.ParseDuration(ctx.GlobalString("key-expiry"))
+	if err != nil {
+		return opts, err
+	}
+
+	opts.CacheableScripts, err = parseScripts(ctx.GlobalString("cacheable-scripts"), exp)
+	if err != nil {
+		return opts, fmt.Errorf("invalid value for --cacheable-scripts: %v", err)
+	}
+
+	opts.PubSubConnections = ctx.GlobalInt("pubsub-connections")
+	opts.PubSubBuffer = ctx.GlobalInt("pubsub-client-buffer")
+	opts.MaxTransactions = ctx.GlobalInt("max-transactions")
+	opts.MaxBatchSize = ctx.GlobalInt("max-batch-size")
+	opts.CompressMinSize = ctx.GlobalInt("compress-min-size")
+	opts.WatchBuffer = ctx.GlobalInt("watch-buffer")
+	opts.WatchMaxClients = ctx.GlobalInt("watch-max-clients")
+	opts.WatchMaxKeys = ctx.GlobalInt("watch-max-keys")
+	opts.KeyspaceNotifications = ctx.GlobalBool("keyspace-notifications")
+	opts.H2C = ctx.GlobalBool("h2c")
+
+	opts.ContentTypes, err = parseContentTypes(ctx.GlobalString("content-types"))
+	if err != nil {
+		return opts, fmt.Errorf("invalid value for --content-types: %v", err)
+	}
+
+	opts.TLS.CertFile = ctx.GlobalString("tls-cert-file")
+	opts.TLS.KeyFile = ctx.GlobalString("tls-key-file")
+	opts.TLS.CAFile = ctx.GlobalString("tls-ca-cert-file")
+	opts.TLS.AuthClients = ctx.GlobalString("tls-auth-clients")
+
+	opts.Upstream.Username = ctx.GlobalString("redis-username")
+	opts.Upstream.Password, err = readPassword(ctx)
+	if err != nil {
+		return opts, err
+	}
+	opts.Upstream.DB = ctx.GlobalInt("redis-db")
+	opts.Upstream.Databases = ctx.GlobalInt("redis-databases")
+
+	opts.Upstream.TLS = ctx.GlobalBool("redis-tls")
+	opts.Upstream.TLSCAFile = ctx.GlobalString("redis-tls-ca-cert-file")
+	opts.Upstream.TLSCertFile = ctx.GlobalString("redis-tls-cert-file")
+	opts.Upstream.TLSKeyFile = ctx.GlobalString("redis-tls-key-file")
+	opts.Upstream.TLSServerName = ctx.GlobalString("redis-tls-server-name")
+	opts.Upstream.TLSInsecureSkipVerify = ctx.GlobalBool("redis-tls-insecure-skip-verify")
+
+	opts.Upstream.PoolSize = ctx.GlobalInt("redis-pool-size")
+	opts.Upstream.MaxRetries = ctx.GlobalInt("redis-max-retries")
+
+	return opts, nil
+}
+
+func readPassword(ctx *cli.Context) (string, error) {
+	password := ctx.GlobalString("redis-password")
+	file := ctx.GlobalString("redis-password-file")
+	if file == "" {
+		return password, nil
+	}
+
+	if password != "" {
+		return "", errors.New("--redis-password and --redis-password-file can't be used together")
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("error reading --redis-password-file: %v", err)
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// parseScripts parses a comma separated list of script SHAs, each
+// optionally followed by the ttl of its results, e.g. "e0e1f9...:30s". def
+// is the ttl of the SHAs without one.
+func parseScripts(s string, def time.Duration) (map[string]time.Duration, error) {
+	scripts := make(map[string]time.Duration)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		sha, ttl := item, def
+		if i := strings.IndexByte(item, ':'); i >= 0 {
+			var err error
+			sha = item[:i]
+			ttl, err = time.ParseDuration(item[i+1:])
+			if err != nil || ttl <= 0 {
+				return nil, fmt.Errorf("invalid ttl for script %s", sha)
+			}
+		}
+
+		if b, err := hex.DecodeString(sha); err != nil || len(b) != sha1.Size {
+			return nil, fmt.Errorf("invalid script sha %s", sha)
+		}
+
+		scripts[strings.ToLower(sha)] = ttl
+	}
+
+	return scripts, nil
+}
+
+// parseContentTypes parses a comma separated list of key patterns and the
+// content type of their values, e.g. "user:*=application/json".
+func parseContentTypes(s string) ([]proxy.ContentTypeRule, error) {
+	var rules []proxy.ContentTypeRule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		i := strings.IndexByte(item, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("missing content type for %s", item)
+		}
+
+		pattern, typ := item[:i], strings.TrimSpace(item[i+1:])
+		if _, _, err := mime.ParseMediaType(typ); err != nil {
+			return nil, fmt.Errorf("invalid content type %s", typ)
+		}
+
+		rules = append(rules, proxy.ContentTypeRule{Pattern: pattern, Type: typ})
+	}
+
+	return rules, nil
+}
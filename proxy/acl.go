@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultUser = "default"
+
+// user is an identity allowed to use the proxy. Commands and Keys are the
+// allowed command names and key patterns, "*" allows everything.
+type user struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password"`
+	Tokens   []string `json:"tokens"`
+	Commands []string `json:"commands"`
+	Keys     []string `json:"keys"`
+}
+
+// can reports whether the user is allowed to run cmd on all the given keys.
+func (u *user) can(cmd string, keys ...string) bool {
+	allowed := false
+	for _, c := range u.Commands {
+		if c == "*" || strings.ToLower(c) == cmd {
+			allowed = true
+			break
+		}
+	}
+
+	if !allowed {
+		return false
+	}
+
+	for _, k := range keys {
+		if !u.canAccess(k) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (u *user) canAccess(key string) bool {
+	for _, p := range u.Keys {
+		if globMatch(p, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type users struct {
+	byName  map[string]*user
+	byToken map[string]*user
+}
+
+func newUsers(list []*user) (*users, error) {
+	u := &users{
+		byName:  make(map[string]*user),
+		byToken: make(map[string]*user),
+	}
+
+	for _, usr := range list {
+		if usr.Name == "" {
+			return nil, fmt.Errorf("users must have a name")
+		}
+
+		if _, ok := u.byName[usr.Name]; ok {
+			return nil, fmt.Errorf("duplicated user %s", usr.Name)
+		}
+		u.byName[usr.Name] = usr
+
+		for _, t := range usr.Tokens {
+			if _, ok := u.byToken[t]; ok {
+				return nil, fmt.Errorf("token of user %s is already in use", usr.Name)
+			}
+			u.byToken[t] = usr
+		}
+	}
+
+	return u, nil
+}
+
+// loadUsers reads the users from a JSON file holding a list of users.
+func loadUsers(file string) (*users, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*user
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("error parsing users file %s: %v", file, err)
+	}
+
+	u, err := newUsers(list)
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"file":  file,
+		"users": len(list),
+	}).Debug("users loaded")
+
+	return u, nil
+}
+
+// authenticate returns the user matching name and password, or nil.
+func (u *users) authenticate(name string, password string) *user {
+	usr, ok := u.byName[name]
+	if !ok || usr.Password == "" {
+		return nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(usr.Password), []byte(password)) != 1 {
+		return nil
+	}
+
+	return usr
+}
+
+// fromCertificate returns the user named after the common name of a
+// verified client certificate.
+func (u *users) fromCertificate(state *tls.ConnectionState) *user {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+
+	return u.byName[state.VerifiedChains[0][0].Subject.CommonName]
+}
+
+// fromRequest returns the user owning the API key or bearer token of r,
+// falling back to its client certificate.
+func (u *users) fromRequest(r *http.Request) *user {
+	token := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); token == "" && strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	if token == "" {
+		return u.fromCertificate(r.TLS)
+	}
+
+	return u.byToken[token]
+}
+
+// authorize checks that the request is allowed to run cmd on keys, replying
+// with 401 or 403 otherwise. Without users every request is allowed.
+func authorize(u *users, w http.ResponseWriter, r *http.Request, cmd string, keys ...string) bool {
+	if u == nil {
+		return true
+	}
+
+	usr := u.fromRequest(r)
+	if usr == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="rp"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	if !usr.can(cmd, keys...) {
+		log.WithFields(log.Fields{
+			"user":    usr.Name,
+			"command": cmd,
+			"keys":    keys,
+		}).Debug("request denied by ACL")
+
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
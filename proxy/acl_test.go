@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+const usersJSON = `[
+	{"name": "app", "password": "p4ss", "tokens": ["t0k3n"], "commands": ["get"], "keys": ["user:*"]},
+	{"name": "admin", "password": "4dm1n", "commands": ["*"], "keys": ["*"]}
+]`
+
+type SuiteACL struct {
+	suite.Suite
+	u *users
+}
+
+func (s *SuiteACL) SetupSuite() {
+	f, err := ioutil.TempFile("", "users")
+	if err != nil {
+		s.FailNow("error creating users file", err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(usersJSON)
+	f.Close()
+
+	s.u, err = loadUsers(f.Name())
+	if err != nil {
+		s.FailNow("error loading users file", err)
+	}
+}
+
+func (s *SuiteACL) TestAuthenticate() {
+	s.NotNil(s.u.authenticate("app", "p4ss"), "should authenticate with valid password")
+	s.Nil(s.u.authenticate("app", "wrong"), "shouldn't authenticate with invalid password")
+	s.Nil(s.u.authenticate("nobody", "p4ss"), "shouldn't authenticate unknown users")
+}
+
+func (s *SuiteACL) TestCan() {
+	app := s.u.byName["app"]
+	s.True(app.can("get", "user:1"), "should allow listed command and key")
+	s.False(app.can("get", "session:1"), "shouldn't allow unlisted key")
+	s.False(app.can("mget", "user:1"), "shouldn't allow unlisted command")
+
+	admin := s.u.byName["admin"]
+	s.True(admin.can("get", "session:1"), "should allow everything")
+}
+
+func (s *SuiteACL) TestAuthorize() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorize(s.u, w, r, "get", r.FormValue("key")) {
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+
+	cases := []struct {
+		key    string
+		header string
+		value  string
+		code   int
+	}{
+		{"user:1", "", "", http.StatusUnauthorized},
+		{"user:1", "Authorization", "Bearer wrong", http.StatusUnauthorized},
+		{"user:1", "Authorization", "Bearer t0k3n", http.StatusOK},
+		{"user:1", "X-API-Key", "t0k3n", http.StatusOK},
+		{"session:1", "X-API-Key", "t0k3n", http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/?key="+c.key, nil)
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		s.Equal(c.code, w.Code, "unexpected status for %s %s", c.key, c.value)
+	}
+}
+
+func TestACLSuite(t *testing.T) {
+	suite.Run(t, new(SuiteACL))
+}
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*", "anything/at:all", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users:1", false},
+		{"user:?", "user:1", true},
+		{"user:?", "user:10", false},
+		{"user:[0-4]", "user:3", true},
+		{"user:[^0-4]", "user:3", false},
+		{"user:[ab]", "user:b", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"*:*:end", "a:b:c:end", true},
+		{"*:*:end", "a:b:c:en", false},
+		{"a*", "", false},
+		{"**", "", true},
+		{"*[ab]", "xxb", true},
+		{"*\\*", "x*", true},
+		{"*a*a*a*a*a*a*a*a*a*a*a*b", strings.Repeat("a", 100), false},
+	}
+
+	for _, c := range cases {
+		if globMatch(c.pattern, c.s) != c.match {
+			t.Errorf("globMatch(%q, %q) should be %v", c.pattern, c.s, c.match)
+		}
+	}
+}
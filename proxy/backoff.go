@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// backoff returns how long to wait before the given retry attempt. The delay
+// grows exponentially from min and is capped at max, with full jitter so that
+// workers retrying at the same time don't hit redis in lockstep.
+func backoff(attempt int, min time.Duration, max time.Duration) time.Duration {
+	if attempt <= 0 || max <= 0 {
+		return 0
+	}
+
+	d := min << uint(attempt-1)
+	if d > max || d <= 0 {
+		d = max
+	}
+
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryable reports whether err is a network error that is worth retrying,
+// as opposed to a reply sent by redis.
+func retryable(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	_, ok := err.(net.Error)
+	return ok
+}
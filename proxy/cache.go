@@ -2,76 +2,498 @@ package proxy
 
 import (
 	"container/list"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// entry is a cached reply. val holds a value as returned by go-redis: a
+// string, an int64, a []interface{} or nil. Entries derived from other
+// keys, like the reply of an HGET or of a script, keep the keys they were
+// derived from in bases so they can be invalidated along with them.
 type entry struct {
-	key string
-	val string
-	exp time.Time
+	key   string
+	val   interface{}
+	exp   time.Time
+	bases []string
+	meta  *keyMeta
+	// at is when the value was read from redis.
+	at time.Time
+	// gen is the generation of the keys of the entry when it was read,
+	// see cache.generation.
+	gen uint64
+}
+
+// keyMeta is what is known about a key in redis, used to answer commands
+// like TYPE or TTL without a round trip.
+type keyMeta struct {
+	kind string
+	// expireAt is when the key expires in redis, zero if it doesn't.
+	expireAt time.Time
+}
+
+// newKeyMeta builds the metadata of a key of the given type, with a ttl as
+// returned by PTTL.
+func newKeyMeta(kind string, ttl time.Duration) *keyMeta {
+	m := &keyMeta{kind: kind}
+	if ttl >= 0 {
+		m.expireAt = time.Now().Add(ttl)
+	}
+
+	return m
+}
+
+// ttl returns the time left until the key expires, -1 if it doesn't.
+func (m *keyMeta) ttl(now time.Time) time.Duration {
+	if m.expireAt.IsZero() {
+		return -1
+	}
+
+	if d := m.expireAt.Sub(now); d > 0 {
+		return d
+	}
+
+	return 0
+}
+
+// ttlSeconds returns the ttl rounded to seconds like TTL does, -1 if the
+// key doesn't expire.
+func (m *keyMeta) ttlSeconds(now time.Time) int64 {
+	ttl := m.ttl(now)
+	if ttl < 0 {
+		return -1
+	}
+
+	return int64((ttl + time.Millisecond*500) / time.Second)
 }
 
 type cache struct {
-	m   map[string]*list.Element
-	l   *list.List
-	exp time.Duration
-	cap int
+	// hits, misses and evictions are counters reported by INFO, accessed
+	// atomically.
+	hits      int64
+	misses    int64
+	evictions int64
+
+	m       map[string]*list.Element
+	l       *list.List
+	derived map[string]map[string]struct{}
+	exp     time.Duration
+	cap     int
 
 	mu sync.RWMutex
 	w  *writer
+
+	// changed is called with the keys invalidated, and flushed with the
+	// database flushed, -1 for all of them. They're called with mu held,
+	// so they must not block. Both are optional, and set before the cache
+	// is used.
+	changed func(keys []string)
+	flushed func(db int)
+
+	// gens counts the invalidations of the keys hashing to each slot,
+	// accessed atomically and only written with mu held.
+	gens [genSlots]uint64
+
+	// index lists in order the keys cached with their value, as opposed
+	// to derived replies, and may still hold keys removed since. added
+	// counts the keys added, and indexed the ones counted when index was
+	// built, it's rebuilt when listing keys after others were added.
+	index   []string
+	added   uint64
+	indexed uint64
+}
+
+// genSlots is the number of generations keys are spread over. Keys sharing
+// a slot only cause extra misses.
+const genSlots = 4096
+
+func genSlot(k string) int {
+	h := fnv.New32a()
+	h.Write([]byte(k))
+	return int(h.Sum32() % genSlots)
+}
+
+// generation returns a number that changes whenever any of keys is
+// invalidated. It's taken before reading a value from redis, and the value
+// is only cached if it hasn't changed by the time it's written, so a read
+// racing with a write can't cache the value from before the write.
+func (c *cache) generation(keys ...string) uint64 {
+	var gen uint64
+	for _, k := range keys {
+		gen += atomic.LoadUint64(&c.gens[genSlot(k)])
+	}
+
+	return gen
+}
+
+// bump counts an invalidation of k, c.mu must be held.
+func (c *cache) bump(k string) {
+	atomic.AddUint64(&c.gens[genSlot(k)], 1)
+}
+
+// derivedKey is the cache key of the reply to a command reading a key,
+// e.g. "hget\x00user:1\x00name" for HGET user:1 name.
+func derivedKey(args []string) string {
+	return strings.Join(args, "\x00")
+}
+
+// dbKey namespaces the cache key k by the redis database it belongs to.
+func dbKey(db int, k string) string {
+	return strconv.Itoa(db) + "\x00" + k
+}
+
+func dbKeys(db int, keys []string) []string {
+	ns := make([]string, len(keys))
+	for i, k := range keys {
+		ns[i] = dbKey(db, k)
+	}
+
+	return ns
 }
 
 func (c *cache) get(k string) string {
+	v, _ := c.getValue(k)
+	s, _ := v.(string)
+	return s
+}
+
+// getValue returns the value cached for k, and whether it was found.
+func (c *cache) getValue(k string) (interface{}, bool) {
+	e, ok := c.lookup(k)
+	if !ok {
+		return nil, false
+	}
+
+	return e.val, true
+}
+
+// lookup returns the entry cached for k. Entries are never modified once
+// written, so it's safe to use after the lock is released.
+func (c *cache) lookup(k string) (*entry, bool) {
+	return c.lookupStale(k, 0)
+}
+
+// lookupStale is like lookup, also returning entries expired for up to
+// maxStale, or for any time if it's negative. Stale entries are left in
+// the cache, to be dropped by the next lookup not accepting them.
+func (c *cache) lookupStale(k string, maxStale time.Duration) (*entry, bool) {
+	c.mu.RLock()
+	el, ok := c.m[k]
+	var e *entry
+	if ok {
+		e = el.Value.(*entry)
+	}
+	c.mu.RUnlock()
+
+	if !ok {
+		log.WithFields(log.Fields{
+			"key": k,
+		}).Debug("key doesn't exist in cache")
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+
+	now := time.Now()
+	if now.After(e.exp) && (maxStale < 0 || !now.After(e.exp.Add(maxStale))) {
+		atomic.AddInt64(&c.hits, 1)
+		return e, true
+	}
+
+	// the writer takes the write lock, so it's notified without holding
+	// the read lock
+	c.w.q <- writeOp{e, true}
+	if now.After(e.exp) {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+
+	atomic.AddInt64(&c.hits, 1)
+	return e, true
+}
+
+// set caches v under k, whatever the generation of k.
+func (c *cache) set(k string, v string) {
+	c.setValue(k, v, c.generation(k))
+}
+
+// setValue caches v under k, read at the generation gen of its keys: k, or
+// bases if any. The entry is dropped whenever any of bases is invalidated.
+// It returns the entry written.
+func (c *cache) setValue(k string, v interface{}, gen uint64, bases ...string) *entry {
+	return c.setExpiring(k, v, c.exp, gen, bases...)
+}
+
+// setExpiring is like setValue, with a ttl other than the cache's expiry.
+// It returns the entry written.
+func (c *cache) setExpiring(k string, v interface{}, ttl time.Duration, gen uint64, bases ...string) *entry {
+	now := time.Now()
+	e := &entry{k, v, now.Add(ttl), bases, nil, now, gen}
+	c.w.q <- writeOp{e, false}
+
+	return e
+}
+
+// setMeta caches v under k along with the key's metadata, if known, read
+// at the generation gen of k. The entry never outlives the key in redis.
+// It returns the entry written.
+func (c *cache) setMeta(k string, v interface{}, meta *keyMeta, gen uint64) *entry {
+	now := time.Now()
+	exp := now.Add(c.exp)
+	if meta != nil && !meta.expireAt.IsZero() && meta.expireAt.Before(exp) {
+		exp = meta.expireAt
+	}
+
+	e := &entry{k, v, exp, nil, meta, now, gen}
+	c.w.q <- writeOp{e, false}
+
+	return e
+}
+
+// keys returns the keys the generation of e is taken from.
+func (e *entry) keys() []string {
+	if len(e.bases) > 0 {
+		return e.bases
+	}
+
+	return []string{e.key}
+}
+
+// len returns the number of cached entries, including the expired ones
+// not yet removed.
+func (c *cache) len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.l.Len()
+}
+
+// keysScanFactor bounds the keys looked at by a call to keys to that many
+// times the keys asked for.
+const keysScanFactor = 10
+
+// keys returns, in order, up to count of the keys of db cached with their
+// value and matching the pattern match, starting after the key after. When
+// kind is set only keys of that type are returned. Replies derived from
+// keys and expired entries are skipped. It also returns the key to continue
+// from, "" once every key was listed. Like SCAN, fewer keys than count may
+// be returned before the end, as the keys looked at are bounded.
+func (c *cache) keys(db int, match string, kind string, after string, count int) ([]string, string) {
+	index := c.sortedKeys()
+
+	prefix := dbKey(db, "")
+	i := sort.SearchStrings(index, prefix+after)
+	if after != "" && i < len(index) && index[i] == prefix+after {
+		i++
+	}
+
+	now := time.Now()
+
+	// keys are matched against the index without holding mu, which is only
+	// held to look up their entries
+	var keys []string
+	for scanned := 0; i < len(index) && strings.HasPrefix(index[i], prefix); i++ {
+		if len(keys) == count || scanned == count*keysScanFactor {
+			return keys, index[i-1][len(prefix):]
+		}
+		scanned++
+
+		key := index[i][len(prefix):]
+		if match != "" && !globMatch(match, key) {
+			continue
+		}
+
+		if c.listed(index[i], kind, now) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, ""
+}
+
+// listed reports whether the entry of k is cached, unexpired and of kind,
+// when it's set.
+func (c *cache) listed(k string, kind string, now time.Time) bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
 	el, ok := c.m[k]
 	if !ok {
+		return false
+	}
+
+	e := el.Value.(*entry)
+	if len(e.bases) > 0 || now.After(e.exp) {
+		return false
+	}
+
+	return kind == "" || entryKind(e) == kind
+}
+
+// sortedKeys returns the index of the keys, rebuilding it if keys were
+// added since it was built. Keys are sorted without holding mu.
+func (c *cache) sortedKeys() []string {
+	c.mu.RLock()
+	if c.indexed == c.added {
+		index := c.index
+		c.mu.RUnlock()
+		return index
+	}
+
+	added := c.added
+	index := make([]string, 0, len(c.m))
+	for k, el := range c.m {
+		if len(el.Value.(*entry).bases) == 0 {
+			index = append(index, k)
+		}
+	}
+	c.mu.RUnlock()
+
+	sort.Strings(index)
+
+	c.mu.Lock()
+	if added > c.indexed {
+		c.index, c.indexed = index, added
+	}
+	c.mu.Unlock()
+
+	return index
+}
+
+// entryKind returns the type of the key cached in e. Entries without
+// metadata hold strings, as fetched by MGET.
+func entryKind(e *entry) string {
+	if e.meta != nil {
+		return e.meta.kind
+	}
+
+	return "string"
+}
+
+// invalidate drops the given keys and every entry derived from them.
+func (c *cache) invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, k := range keys {
+		c.bump(k)
+		c.remove(k)
+		for d := range c.derived[k] {
+			c.remove(d)
+		}
+		delete(c.derived, k)
+
 		log.WithFields(log.Fields{
 			"key": k,
-		}).Debug("key doesn't exist in cache")
-		return ""
+		}).Debug("key invalidated")
+	}
+
+	if c.changed != nil {
+		c.changed(keys)
+	}
+}
+
+// flush drops every entry of the database db, or of all of them if db is
+// negative.
+func (c *cache) flush(db int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// values being read may belong to the database, whatever their key
+	for i := range c.gens {
+		atomic.AddUint64(&c.gens[i], 1)
+	}
+
+	prefix := dbKey(db, "")
+	for k := range c.m {
+		if db < 0 || strings.HasPrefix(k, prefix) {
+			c.remove(k)
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"db": db,
+	}).Debug("cache flushed")
+
+	if c.flushed != nil {
+		c.flushed(db)
+	}
+}
+
+// remove deletes k from the cache, c.mu must be held.
+func (c *cache) remove(k string) {
+	el, ok := c.m[k]
+	if !ok {
+		return
 	}
 
 	e := el.Value.(*entry)
-	if time.Now().After(e.exp) {
-		c.w.q <- e
-		return ""
+	for _, b := range e.bases {
+		delete(c.derived[b], k)
+		if len(c.derived[b]) == 0 {
+			delete(c.derived, b)
+		}
 	}
 
-	c.w.q <- e
-	return e.val
+	c.l.Remove(el)
+	delete(c.m, k)
 }
 
-func (c *cache) set(k string, v string) {
-	exp := time.Now().Add(c.exp)
-	c.w.q <- &entry{k, v, exp}
+// writeOp is a pending write to the cache. touch moves an entry that was
+// read to the front without inserting it again if it's gone.
+type writeOp struct {
+	e     *entry
+	touch bool
 }
 
 type writer struct {
-	q chan *entry
+	q chan writeOp
 	c *cache
 }
 
-func (w *writer) write(e *entry) {
+func (w *writer) write(op writeOp) {
 	c := w.c
+	e := op.e
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if !op.touch && c.generation(e.keys()...) != e.gen {
+		log.WithFields(log.Fields{
+			"key": e.key,
+		}).Debug("key invalidated while being read, not cached")
+		return
+	}
+
 	el, ok := c.m[e.key]
 	if !ok {
+		if op.touch {
+			return
+		}
+
 		if c.l.Len() == c.cap {
 			b := c.l.Back()
-			delete(c.m, b.Value.(*entry).key)
-			c.l.Remove(b)
+			c.remove(b.Value.(*entry).key)
+			atomic.AddInt64(&c.evictions, 1)
 		}
 
 		el = c.l.PushFront(e)
 		c.m[e.key] = el
+		if len(e.bases) == 0 {
+			c.added++
+		}
+
+		for _, b := range e.bases {
+			if c.derived[b] == nil {
+				c.derived[b] = make(map[string]struct{})
+			}
+			c.derived[b][e.key] = struct{}{}
+		}
 
 		log.WithFields(log.Fields{
 			"key":   e.key,
@@ -80,6 +502,10 @@ func (w *writer) write(e *entry) {
 		return
 	}
 
+	if !op.touch {
+		el.Value = e
+	}
+
 	log.WithFields(log.Fields{
 		"key": e.key,
 	}).Debug("key found in cache, moving to front")
@@ -92,10 +518,13 @@ func (w *writer) del(e *entry) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	el := c.m[e.key]
-	c.l.Remove(el)
+	// the key may have been replaced or invalidated since it was read
+	el, ok := c.m[e.key]
+	if !ok || el.Value.(*entry) != e {
+		return
+	}
 
-	delete(c.m, e.key)
+	c.remove(e.key)
 
 	log.WithFields(log.Fields{
 		"key": e.key,
@@ -105,19 +534,19 @@ func (w *writer) del(e *entry) {
 func (w *writer) run() {
 	log.Debug("cache writer is running")
 
-	for e := range w.q {
-		if time.Now().After(e.exp) {
-			w.del(e)
+	for op := range w.q {
+		if time.Now().After(op.e.exp) {
+			w.del(op.e)
 			continue
 		}
 
-		w.write(e)
+		w.write(op)
 	}
 }
 
 func newWriter(c *cache, s int) *writer {
 	return &writer{
-		q: make(chan *entry, s),
+		q: make(chan writeOp, s),
 		c: c,
 	}
 }
@@ -127,10 +556,11 @@ func newCache(cap int, exp time.Duration, s int) *cache {
 	l := list.New()
 
 	c := &cache{
-		cap: cap,
-		exp: exp,
-		m:   m,
-		l:   l,
+		cap:     cap,
+		exp:     exp,
+		m:       m,
+		l:       l,
+		derived: make(map[string]map[string]struct{}),
 	}
 
 	c.w = newWriter(c, s)
@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -53,6 +55,134 @@ func (s *SuiteCache) TestGet() {
 	s.Equal("v00", v, "should get value for existing key")
 }
 
+func (s *SuiteCache) TestInvalidate() {
+	s.c.setValue(derivedKey([]string{"hget", "h00", "f00"}), "v00", s.c.generation("h00"), "h00")
+	s.c.setValue(derivedKey([]string{"hget", "h00", "f01"}), nil, s.c.generation("h00"), "h00")
+	<-time.After(time.Millisecond * 5)
+
+	v, ok := s.c.getValue(derivedKey([]string{"hget", "h00", "f01"}))
+	s.True(ok, "nil replies should be cached")
+	s.Nil(v, "nil replies should be cached as nil")
+
+	s.c.invalidate("h00")
+
+	_, ok = s.c.getValue(derivedKey([]string{"hget", "h00", "f00"}))
+	s.False(ok, "derived entries should be invalidated with their key")
+	s.Empty(s.c.derived, "derived index should be emptied")
+}
+
+// fill writes e as the writer would once it's dequeued, so reads and
+// writes can be interleaved deterministically.
+func fill(c *cache, k string, v interface{}, gen uint64, bases ...string) {
+	c.w.write(writeOp{&entry{key: k, val: v, exp: time.Now().Add(time.Minute), bases: bases, gen: gen}, false})
+}
+
+func TestFillRacingWrite(t *testing.T) {
+	c := newCache(cacheCap, defaultExp, maxWorkers)
+
+	// a GET reads the old value, a SET lands and invalidates the key, then
+	// the GET fills the cache
+	gen := c.generation("k00")
+	c.invalidate("k00")
+	fill(c, "k00", "old", gen)
+	if _, ok := c.getValue("k00"); ok {
+		t.Error("a value read before an invalidation shouldn't be cached")
+	}
+
+	// same for a reply derived from the key
+	hget := derivedKey([]string{"hget", "h00", "f00"})
+	gen = c.generation("h00")
+	c.invalidate("h00")
+	fill(c, hget, "old", gen, "h00")
+	if _, ok := c.getValue(hget); ok {
+		t.Error("a reply read before an invalidation of its key shouldn't be cached")
+	}
+
+	// a SET caching its own value invalidates the key once
+	gen = c.generation("k01")
+	c.invalidate("k01")
+	fill(c, "k01", "new", gen+1)
+	if v, _ := c.getValue("k01"); v != "new" {
+		t.Errorf("a written value should be cached, got %v", v)
+	}
+
+	// another SET landed in between, its value may be the newest
+	gen = c.generation("k01")
+	c.invalidate("k01")
+	c.invalidate("k01")
+	fill(c, "k01", "stale", gen+1)
+	if _, ok := c.getValue("k01"); ok {
+		t.Error("a written value shouldn't be cached after a concurrent write")
+	}
+
+	// reads started after the invalidation are cached
+	fill(c, "k00", "new", c.generation("k00"))
+	if v, _ := c.getValue("k00"); v != "new" {
+		t.Errorf("a value read after the invalidation should be cached, got %v", v)
+	}
+
+	gen = c.generation("k02")
+	c.flush(-1)
+	fill(c, "k02", "old", gen)
+	if _, ok := c.getValue("k02"); ok {
+		t.Error("a value read before a flush shouldn't be cached")
+	}
+}
+
+func TestCacheKeys(t *testing.T) {
+	c := newCache(100, time.Minute, maxWorkers)
+	for _, k := range []string{"u:2", "u:1", "u:3"} {
+		c.setValue(dbKey(0, k), "v", c.generation(dbKey(0, k)))
+	}
+	for i := 0; i < 15; i++ {
+		k := fmt.Sprintf("a:%02d", i)
+		c.setValue(dbKey(0, k), "v", c.generation(dbKey(0, k)))
+	}
+	c.setValue(dbKey(1, "u:0"), "v", c.generation(dbKey(1, "u:0")))
+	c.setValue(dbKey(0, derivedKey([]string{"hget", "u:0", "f"})), "v", c.generation(dbKey(0, "u:0")), dbKey(0, "u:0"))
+	<-time.After(time.Millisecond * 5)
+
+	var all []string
+	pos := ""
+	for {
+		keys, next := c.keys(0, "u:*", "", pos, 1)
+		all = append(all, keys...)
+		if next == "" {
+			break
+		}
+		pos = next
+	}
+
+	if strings.Join(all, ",") != "u:1,u:2,u:3" {
+		t.Errorf("keys should be listed in order, got %v", all)
+	}
+
+	// the keys looked at are bounded, even when none of them match
+	keys, next := c.keys(0, "u:*", "", "", 1)
+	if len(keys) != 0 || next != "a:09" {
+		t.Errorf("unexpected page %v %q", keys, next)
+	}
+
+	// patterns are matched in linear time
+	long := strings.Repeat("a", 100)
+	c.setValue(dbKey(0, long), "v", c.generation(dbKey(0, long)))
+	<-time.After(time.Millisecond * 5)
+
+	keys, _ = c.keys(0, "*a*a*a*a*a*a*a*a*a*a*a*a*b", "", "", 10)
+	if len(keys) != 0 {
+		t.Errorf("no key should match, got %v", keys)
+	}
+
+	c.invalidate(dbKey(0, "u:1"))
+	c.setValue(dbKey(0, "u:0"), "v", c.generation(dbKey(0, "u:0")))
+	<-time.After(time.Millisecond * 5)
+
+	keys, _ = c.keys(0, "u:*", "", "", 10)
+	if strings.Join(keys, ",") != "u:0,u:2,u:3" {
+		t.Errorf("keys added and removed should be listed accordingly, got %v", keys)
+	}
+}
+
 func getCacheKeys(c *cache) []string {
 	l := c.l
 	k := []string{}
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// register adds the connection to the clients listed by CLIENT LIST.
+func (r *redisServer) register(c *redisConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.clients == nil {
+		r.clients = make(map[int64]*redisConn)
+	}
+
+	r.nextID++
+	c.id = r.nextID
+	r.clients[c.id] = c
+
+	atomic.AddInt64(&r.connections, 1)
+}
+
+func (r *redisServer) unregister(c *redisConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.clients, c.id)
+}
+
+// connected returns the clients currently connected, sorted by id.
+func (r *redisServer) connected() []*redisConn {
+	r.mu.Lock()
+	list := make([]*redisConn, 0, len(r.clients))
+	for _, c := range r.clients {
+		list = append(list, c)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	return list
+}
+
+// touch records the command being run by the client.
+func (c *redisConn) touch(cmd string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cmd = cmd
+	c.active = time.Now()
+}
+
+func (c *redisConn) getName() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.name
+}
+
+const errClientName = "ERR Client names cannot contain spaces, newlines or special characters."
+
+// validClientName checks name can be set by CLIENT SETNAME or HELLO.
+func validClientName(name string) bool {
+	return strings.IndexFunc(name, func(r rune) bool { return r <= ' ' || r > '~' }) < 0
+}
+
+func (c *redisConn) setName(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.name = name
+}
+
+// userName returns the name of the authenticated user, c.user is only
+// set by the connection's own goroutine while holding c.mu.
+func (c *redisConn) userName() string {
+	if c.user == nil {
+		return defaultUser
+	}
+
+	return c.user.Name
+}
+
+// info describes the client in the format of CLIENT LIST.
+func (c *redisConn) info(now time.Time) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return fmt.Sprintf("id=%d addr=%s laddr=%s fd=-1 name=%s age=%d idle=%d db=%d user=%s cmd=%s\n",
+		c.id,
+		c.conn.RemoteAddr(),
+		c.conn.LocalAddr(),
+		c.name,
+		int64(now.Sub(c.created)/time.Second),
+		int64(now.Sub(c.active)/time.Second),
+		c.db,
+		c.userName(),
+		c.cmd,
+	)
+}
+
+// client handles the CLIENT subcommands on the proxy's own connections.
+func (r *redisServer) client(c *redisConn, args []string) {
+	sub := strings.ToLower(args[1])
+
+	switch {
+	case sub == "list":
+		now := time.Now()
+		var buf bytes.Buffer
+		for _, cl := range r.connected() {
+			buf.WriteString(cl.info(now))
+		}
+		c.writeBulk(buf.String())
+	case sub == "info" && len(args) == 2:
+		c.writeBulk(c.info(time.Now()))
+	case sub == "id" && len(args) == 2:
+		c.writeInt(c.id)
+	case sub == "getname" && len(args) == 2:
+		name := c.getName()
+		if name == "" {
+			c.writeNil()
+			return
+		}
+		c.writeBulk(name)
+	case sub == "setname" && len(args) == 3:
+		if !validClientName(args[2]) {
+			c.writeError(errClientName)
+			return
+		}
+		c.setName(args[2])
+		c.writeStatus("OK")
+	case sub == "setinfo" && len(args) == 4:
+		c.writeStatus("OK")
+	case sub == "kill" && len(args) >= 3:
+		r.kill(c, args[2:])
+	default:
+		c.writeError(fmt.Sprintf("ERR Unknown subcommand or wrong number of arguments for '%s'. Try CLIENT HELP.", args[1]))
+	}
+}
+
+// kill handles CLIENT KILL addr and CLIENT KILL with filters. Connections
+// are closed right away, except the client's own which is closed once the
+// reply is sent.
+func (r *redisServer) kill(c *redisConn, args []string) {
+	if len(args) == 1 {
+		for _, cl := range r.connected() {
+			if cl.conn.RemoteAddr().String() == args[0] {
+				r.closeClient(c, cl)
+				c.writeStatus("OK")
+				return
+			}
+		}
+
+		c.writeError("ERR No such client")
+		return
+	}
+
+	if len(args)%2 != 0 {
+		c.writeError("ERR syntax error")
+		return
+	}
+
+	match := []func(*redisConn) bool{}
+	skipMe := true
+	for i := 0; i < len(args); i += 2 {
+		v := args[i+1]
+
+		switch strings.ToLower(args[i]) {
+		case "id":
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || id <= 0 {
+				c.writeError("ERR client-id should be greater than 0")
+				return
+			}
+			match = append(match, func(cl *redisConn) bool { return cl.id == id })
+		case "addr":
+			match = append(match, func(cl *redisConn) bool { return cl.conn.RemoteAddr().String() == v })
+		case "laddr":
+			match = append(match, func(cl *redisConn) bool { return cl.conn.LocalAddr().String() == v })
+		case "user":
+			match = append(match, func(cl *redisConn) bool {
+				cl.mu.Lock()
+				defer cl.mu.Unlock()
+
+				return cl.userName() == v
+			})
+		case "skipme":
+			switch strings.ToLower(v) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				c.writeError("ERR syntax error")
+				return
+			}
+		default:
+			c.writeError("ERR syntax error")
+			return
+		}
+	}
+
+	var killed int64
+	for _, cl := range r.connected() {
+		if skipMe && cl == c {
+			continue
+		}
+
+		ok := true
+		for _, m := range match {
+			ok = ok && m(cl)
+		}
+
+		if ok {
+			r.closeClient(c, cl)
+			killed++
+		}
+	}
+
+	c.writeInt(killed)
+}
+
+// closeClient closes the connection of cl, killed by c.
+func (r *redisServer) closeClient(c *redisConn, cl *redisConn) {
+	if cl == c {
+		c.quit = true
+		return
+	}
+
+	cl.conn.Close()
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"strings"
+)
+
+const (
+	// cmdCached commands are read only, their replies are cached under
+	// a key derived from their args and invalidated with their key.
+	cmdCached = 1 << iota
+	// cmdWrite commands are forwarded to redis and invalidate their keys.
+	cmdWrite
+	// cmdMeta commands are answered from the metadata or the value of
+	// cached keys when it's known, and forwarded otherwise.
+	cmdMeta
+	// cmdScript commands run Lua scripts, their keys follow numkeys.
+	cmdScript
+	// cmdStatus commands reply with a status, like +OK, rather than with
+	// a bulk string.
+	cmdStatus
+)
+
+// commandSpec describes a command the proxy understands, using the same
+// conventions as redis' COMMAND: a positive arity is exact, a negative one is
+// a minimum, and keys are found from firstKey to lastKey every step args.
+type commandSpec struct {
+	arity    int
+	firstKey int
+	lastKey  int
+	step     int
+	flags    int
+}
+
+var commandTable = map[string]commandSpec{
+	"get":   {2, 1, 1, 1, 0},
+	"mget":  {-2, 1, -1, 1, 0},
+	"auth":  {-2, 0, 0, 0, 0},
+	"hello": {-1, 0, 0, 0, 0},
+
+	"ping":    {-1, 0, 0, 0, 0},
+	"echo":    {2, 0, 0, 0, 0},
+	"quit":    {1, 0, 0, 0, 0},
+	"info":    {-1, 0, 0, 0, 0},
+	"command": {-1, 0, 0, 0, 0},
+	"client":  {-2, 0, 0, 0, 0},
+
+	"subscribe":    {-2, 0, 0, 0, 0},
+	"psubscribe":   {-2, 0, 0, 0, 0},
+	"unsubscribe":  {-1, 0, 0, 0, 0},
+	"punsubscribe": {-1, 0, 0, 0, 0},
+	"publish":      {3, 0, 0, 0, cmdWrite},
+	"pubsub":       {-2, 0, 0, 0, 0},
+
+	"eval":    {-3, 0, 0, 0, cmdScript},
+	"evalsha": {-3, 0, 0, 0, cmdScript},
+	"script":  {-2, 0, 0, 0, cmdScript},
+
+	"select":   {2, 0, 0, 0, cmdStatus},
+	"flushdb":  {-1, 0, 0, 0, cmdWrite | cmdStatus},
+	"flushall": {-1, 0, 0, 0, cmdWrite | cmdStatus},
+
+	"watch":   {-2, 1, -1, 1, cmdStatus},
+	"unwatch": {1, 0, 0, 0, cmdStatus},
+	"multi":   {1, 0, 0, 0, cmdStatus},
+	"exec":    {1, 0, 0, 0, 0},
+	"discard": {1, 0, 0, 0, cmdStatus},
+
+	"hget":      {3, 1, 1, 1, cmdCached},
+	"hmget":     {-3, 1, 1, 1, cmdCached},
+	"hgetall":   {2, 1, 1, 1, cmdCached},
+	"lrange":    {4, 1, 1, 1, cmdCached},
+	"smembers":  {2, 1, 1, 1, cmdCached},
+	"sismember": {3, 1, 1, 1, cmdCached},
+	"zrange":    {-4, 1, 1, 1, cmdCached},
+	"zscore":    {3, 1, 1, 1, cmdCached},
+
+	"exists": {-2, 1, -1, 1, cmdMeta},
+	"type":   {2, 1, 1, 1, cmdMeta | cmdStatus},
+	"strlen": {2, 1, 1, 1, cmdMeta},
+	"ttl":    {2, 1, 1, 1, cmdMeta},
+	"pttl":   {2, 1, 1, 1, cmdMeta},
+
+	"getrange": {4, 1, 1, 1, cmdMeta},
+	"substr":   {4, 1, 1, 1, cmdMeta},
+
+	"scan": {-2, 0, 0, 0, 0},
+
+	"set":          {-3, 1, 1, 1, cmdWrite | cmdStatus},
+	"setex":        {4, 1, 1, 1, cmdWrite | cmdStatus},
+	"psetex":       {4, 1, 1, 1, cmdWrite | cmdStatus},
+	"setnx":        {3, 1, 1, 1, cmdWrite},
+	"getset":       {3, 1, 1, 1, cmdWrite},
+	"mset":         {-3, 1, -1, 2, cmdWrite | cmdStatus},
+	"append":       {3, 1, 1, 1, cmdWrite},
+	"incr":         {2, 1, 1, 1, cmdWrite},
+	"incrby":       {3, 1, 1, 1, cmdWrite},
+	"incrbyfloat":  {3, 1, 1, 1, cmdWrite},
+	"decr":         {2, 1, 1, 1, cmdWrite},
+	"decrby":       {3, 1, 1, 1, cmdWrite},
+	"del":          {-2, 1, -1, 1, cmdWrite},
+	"unlink":       {-2, 1, -1, 1, cmdWrite},
+	"rename":       {3, 1, 2, 1, cmdWrite | cmdStatus},
+	"expire":       {3, 1, 1, 1, cmdWrite},
+	"pexpire":      {3, 1, 1, 1, cmdWrite},
+	"expireat":     {3, 1, 1, 1, cmdWrite},
+	"pexpireat":    {3, 1, 1, 1, cmdWrite},
+	"persist":      {2, 1, 1, 1, cmdWrite},
+	"hset":         {-4, 1, 1, 1, cmdWrite},
+	"hsetnx":       {4, 1, 1, 1, cmdWrite},
+	"hmset":        {-4, 1, 1, 1, cmdWrite | cmdStatus},
+	"hdel":         {-3, 1, 1, 1, cmdWrite},
+	"hincrby":      {4, 1, 1, 1, cmdWrite},
+	"hincrbyfloat": {4, 1, 1, 1, cmdWrite},
+	"lpush":        {-3, 1, 1, 1, cmdWrite},
+	"rpush":        {-3, 1, 1, 1, cmdWrite},
+	"lpop":         {-2, 1, 1, 1, cmdWrite},
+	"rpop":         {-2, 1, 1, 1, cmdWrite},
+	"lset":         {4, 1, 1, 1, cmdWrite | cmdStatus},
+	"lrem":         {4, 1, 1, 1, cmdWrite},
+	"ltrim":        {4, 1, 1, 1, cmdWrite | cmdStatus},
+	"linsert":      {5, 1, 1, 1, cmdWrite},
+	"sadd":         {-3, 1, 1, 1, cmdWrite},
+	"srem":         {-3, 1, 1, 1, cmdWrite},
+	"spop":         {-2, 1, 1, 1, cmdWrite},
+	"zadd":         {-4, 1, 1, 1, cmdWrite},
+	"zrem":         {-3, 1, 1, 1, cmdWrite},
+	"zincrby":      {4, 1, 1, 1, cmdWrite},
+}
+
+// statusReply is a status reply of redis, like OK, go-redis returning both
+// status replies and bulk strings as strings.
+type statusReply string
+
+// commandReply marks the reply of the command in args as a status reply
+// when the command replies with one.
+func commandReply(args []string, v interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		return v
+	}
+
+	switch args[0] {
+	case "set":
+		// SET with GET replies with the previous value
+		for _, a := range args[3:] {
+			if strings.EqualFold(a, "get") {
+				return v
+			}
+		}
+	case "script":
+		if sub := strings.ToLower(args[1]); sub == "flush" || sub == "kill" {
+			return statusReply(s)
+		}
+	}
+
+	if commandTable[args[0]].flags&cmdStatus == 0 {
+		return v
+	}
+
+	return statusReply(s)
+}
+
+// flagNames returns the flags of the command as reported by COMMAND.
+func (s commandSpec) flagNames() []string {
+	switch {
+	case s.flags&(cmdWrite|cmdScript) != 0:
+		return []string{"write"}
+	case s.firstKey > 0:
+		return []string{"readonly"}
+	}
+
+	return []string{"fast"}
+}
+
+// validArity checks the number of args, including the command name.
+func (s commandSpec) validArity(n int) bool {
+	if s.arity < 0 {
+		return n >= -s.arity
+	}
+
+	return n == s.arity
+}
+
+// commandKeys returns the keys accessed by the command in args.
+func commandKeys(args []string) []string {
+	spec, ok := commandTable[args[0]]
+	if ok && spec.flags&cmdScript != 0 {
+		return scriptKeys(args)
+	}
+
+	if !ok || spec.firstKey == 0 {
+		return nil
+	}
+
+	last := spec.lastKey
+	if last < 0 {
+		last = len(args) + last
+	}
+
+	keys := []string{}
+	for i := spec.firstKey; i <= last && i < len(args); i += spec.step {
+		keys = append(keys, args[i])
+	}
+
+	return keys
+}
@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	// formatJSON wraps a value in a JSON object along with its metadata.
+	formatJSON = "application/json"
+	// formatBase64 is the value encoded in base64.
+	formatBase64 = "application/base64"
+
+	defaultCompressMinSize = 1024
+
+	// sniffLen is the number of bytes http.DetectContentType looks at.
+	sniffLen = 512
+)
+
+// ContentTypeRule sets the content type of the values of the keys
+// matching Pattern, a redis style glob.
+type ContentTypeRule struct {
+	Pattern string
+	Type    string
+}
+
+// contentType returns the content type of the value of key: the type of the
+// first rule matching it, or else the one sniffed from the value.
+func contentType(rules []ContentTypeRule, key string, value []byte) string {
+	for _, rule := range rules {
+		if globMatch(rule.Pattern, key) {
+			return rule.Type
+		}
+	}
+
+	return http.DetectContentType(value)
+}
+
+// acceptHeader returns the Accept header of the request, overridden by the
+// format query parameter: raw, json or base64.
+func acceptHeader(r *http.Request, raw string) string {
+	switch r.URL.Query().Get("format") {
+	case "raw":
+		return mediaType(raw)
+	case "json":
+		return formatJSON
+	case "base64":
+		return formatBase64
+	}
+
+	return r.Header.Get("Accept")
+}
+
+// mediaType strips the parameters of a content type.
+func mediaType(t string) string {
+	if i := strings.IndexByte(t, ';'); i >= 0 {
+		t = t[:i]
+	}
+
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// acceptRange is an element of an Accept or Accept-Encoding header.
+type acceptRange struct {
+	value string
+	q     float64
+}
+
+// parseAccept parses an Accept or Accept-Encoding header, ignoring the
+// parameters other than q.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+
+		r := acceptRange{strings.ToLower(strings.TrimSpace(params[0])), 1}
+		if r.value == "" {
+			continue
+		}
+
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if q, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					r.q = q
+				}
+			}
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	return ranges
+}
+
+// quality returns the q of the most specific range of ranges matching the
+// media type t, -1 if none does.
+func quality(ranges []acceptRange, t string) float64 {
+	q, specificity := -1.0, -1
+	for _, r := range ranges {
+		s := -1
+		switch {
+		case r.value == t:
+			s = 2
+		case strings.HasSuffix(r.value, "/*") && strings.HasPrefix(t, r.value[:len(r.value)-1]):
+			s = 1
+		case r.value == "*/*" || r.value == "*":
+			s = 0
+		}
+
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+
+	return q
+}
+
+// negotiate picks the offer the Accept header prefers, the first one when
+// several are equally good. It reports false if none is acceptable.
+func negotiate(header string, offers ...string) (string, bool) {
+	if header == "" {
+		return offers[0], true
+	}
+
+	ranges := parseAccept(header)
+
+	best, bestQ := "", 0.0
+	for _, o := range offers {
+		if q := quality(ranges, mediaType(o)); q > bestQ {
+			best, bestQ = o, q
+		}
+	}
+
+	return best, best != ""
+}
+
+// acceptEncoding returns the encoding the Accept-Encoding header prefers,
+// brotli winning ties with gzip, or "" if it allows neither.
+func acceptEncoding(header string) string {
+	ranges := parseAccept(header)
+
+	br, gz := quality(ranges, "br"), quality(ranges, "gzip")
+	switch {
+	case br > 0 && br >= gz:
+		return "br"
+	case gz > 0:
+		return "gzip"
+	}
+
+	return ""
+}
+
+// formatValue encodes a string value in the format negotiated with the
+// client, returning the body and its content type. Values are written as
+// they are when the format is their own content type raw.
+func formatValue(format string, key string, value string, raw string, meta *keyMeta) ([]byte, string) {
+	if format == raw {
+		return []byte(value), raw
+	}
+
+	switch format {
+	case formatJSON:
+		v := map[string]interface{}{
+			"key":          key,
+			"value":        value,
+			"encoding":     "utf-8",
+			"content_type": raw,
+		}
+
+		if !utf8.ValidString(value) {
+			v["value"] = base64.StdEncoding.EncodeToString([]byte(value))
+			v["encoding"] = "base64"
+		}
+
+		if meta != nil {
+			v["type"] = meta.kind
+			v["ttl"] = meta.ttlSeconds(time.Now())
+		}
+
+		b, _ := json.Marshal(v)
+		return append(b, '\n'), formatJSON
+	case formatBase64:
+		return []byte(base64.StdEncoding.EncodeToString([]byte(value))), formatBase64
+	}
+
+	return []byte(value), raw
+}
+
+// parseRange parses a Range header with a single range of bytes, returning
+// its first and last offsets, last being -1 for ranges open to the end. A
+// suffix range has a negative first and the number of bytes as last.
+// Multiple ranges aren't supported, and are reported as invalid.
+func parseRange(header string) (int64, int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return 0, 0, false
+	}
+
+	spec := strings.TrimSpace(header[len("bytes="):])
+	i := strings.IndexByte(spec, '-')
+	if i < 0 || strings.IndexByte(spec, ',') >= 0 {
+		return 0, 0, false
+	}
+
+	a, b := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	if a == "" {
+		n, err := strconv.ParseInt(b, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return -1, n, true
+	}
+
+	first, err := strconv.ParseInt(a, 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, false
+	}
+
+	if b == "" {
+		return first, -1, true
+	}
+
+	last, err := strconv.ParseInt(b, 10, 64)
+	if err != nil || last < first {
+		return 0, 0, false
+	}
+
+	return first, last, true
+}
+
+// getrangeOffsets returns the offsets of the GETRANGE reading a range
+// parsed by parseRange, which don't depend on the length of the value.
+func getrangeOffsets(first int64, last int64) (int64, int64) {
+	if first < 0 {
+		return -last, -1
+	}
+
+	return first, last
+}
+
+// resolveRange returns the offsets of a range parsed by parseRange within
+// a value of n bytes, reporting false if it's unsatisfiable.
+func resolveRange(first int64, last int64, n int64) (int64, int64, bool) {
+	if first < 0 {
+		start := n - last
+		if start < 0 {
+			start = 0
+		}
+		return start, n - 1, n > 0
+	}
+
+	if first >= n {
+		return 0, 0, false
+	}
+
+	if last < 0 || last >= n {
+		last = n - 1
+	}
+
+	return first, last, true
+}
+
+// compressBody compresses body with encoding, br or gzip, returning it as
+// is if that fails.
+func compressBody(body []byte, encoding string) ([]byte, bool) {
+	var buf bytes.Buffer
+
+	var zw io.WriteCloser
+	switch encoding {
+	case "br":
+		zw = brotli.NewWriter(&buf)
+	case "gzip":
+		zw = gzip.NewWriter(&buf)
+	default:
+		return body, false
+	}
+
+	if _, err := zw.Write(body); err != nil {
+		return body, false
+	}
+
+	if err := zw.Close(); err != nil {
+		return body, false
+	}
+
+	return buf.Bytes(), true
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"text/plain; charset=utf-8", formatJSON, formatBase64}
+
+	tests := []struct {
+		accept string
+		want   string
+		ok     bool
+	}{
+		{"", offers[0], true},
+		{"*/*", offers[0], true},
+		{"application/json", formatJSON, true},
+		{"text/*;q=0.5, application/base64", formatBase64, true},
+		{"text/html,application/xhtml+xml,*/*;q=0.8", offers[0], true},
+		{"application/json;q=0, */*;q=0.1", offers[0], true},
+		{"image/png", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := negotiate(tt.accept, offers...)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("negotiate(%q) = %q, %v, want %q, %v", tt.accept, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAcceptEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                     "",
+		"gzip, deflate":        "gzip",
+		"gzip, deflate, br":    "br",
+		"br;q=0.5, gzip;q=0.8": "gzip",
+		"*":                    "br",
+		"*, br;q=0":            "gzip",
+		"*, gzip;q=0, br;q=0":  "",
+		"identity":             "",
+	}
+
+	for header, want := range tests {
+		if got := acceptEncoding(header); got != want {
+			t.Errorf("acceptEncoding(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	rules := []ContentTypeRule{
+		{"user:*", "application/json"},
+		{"*", "application/msgpack"},
+	}
+
+	if got := contentType(rules, "user:1", []byte("{}")); got != "application/json" {
+		t.Errorf("first matching rule should win, got %s", got)
+	}
+
+	if got := contentType(rules, "k00", []byte("v00")); got != "application/msgpack" {
+		t.Errorf("catch-all rule should match, got %s", got)
+	}
+
+	if got := contentType(nil, "k00", []byte("v00")); got != "text/plain; charset=utf-8" {
+		t.Errorf("content type should be sniffed without rules, got %s", got)
+	}
+}
+
+func TestByteRange(t *testing.T) {
+	tests := []struct {
+		start, end int64
+		want       string
+	}{
+		{0, 3, "This"},
+		{-3, -1, "ing"},
+		{0, -1, "This is a string"},
+		{10, 100, "string"},
+		{5, 2, ""},
+		{-1, -5, ""},
+	}
+
+	for _, tt := range tests {
+		if got := byteRange("This is a string", tt.start, tt.end); got != tt.want {
+			t.Errorf("byteRange(%d, %d) = %q, want %q", tt.start, tt.end, got, tt.want)
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		start, end int64
+		ok         bool
+	}{
+		{"bytes=0-99", 0, 99, true},
+		{"bytes=100-", 100, 999, true},
+		{"bytes=-100", 900, 999, true},
+		{"bytes=-5000", 0, 999, true},
+		{"bytes=500-5000", 500, 999, true},
+		{"bytes=1000-", 0, 0, false},
+		{"bytes=0-1,5-6", 0, 0, false},
+		{"bytes=9-1", 0, 0, false},
+		{"items=0-1", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		start, end, ok := int64(0), int64(0), false
+		if first, last, valid := parseRange(tt.header); valid {
+			start, end, ok = resolveRange(first, last, 1000)
+		}
+
+		if ok != tt.ok || (ok && (start != tt.start || end != tt.end)) {
+			t.Errorf("range %q = %d-%d, %v, want %d-%d, %v", tt.header, start, end, ok, tt.start, tt.end, tt.ok)
+		}
+	}
+}
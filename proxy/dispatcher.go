@@ -3,16 +3,21 @@ package proxy
 import (
 	"context"
 	"errors"
-	"fmt"
 	"net"
 	"net/http"
 	"time"
 
 	"github.com/go-redis/redis"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
 )
 
-const pollingInterval = time.Millisecond * 500
+const (
+	pollingInterval     = time.Millisecond * 500
+	defaultMaxBatchSize = 1000
+)
+
+var errUnavailable = errors.New("service unavailable")
 
 type Dispatcher struct {
 	ctx     context.Context
@@ -23,33 +28,55 @@ type Dispatcher struct {
 
 	redisSrv *redisServer
 	srv      *http.Server
+	h2s      *http2.Server
+	h2c      bool
 
 	maxWorkers int
 	workers    chan chan Job
 	jobs       chan Job
 	cache      *cache
+	scripts    *scripts
+	users      *users
+	certs      *certReloader
 
 	redisServerPort string
 	redisAddr       string
+
+	requestTimeout      time.Duration
+	healthCheckInterval time.Duration
+	upstream            UpstreamOptions
+	pubsubConns         int
+	pubsubBuffer        int
+	maxTx               int
+	maxBatch            int
+	contentTypes        []ContentTypeRule
+	compressMinSize     int
+	watch               *watchHub
+	watchHeartbeat      time.Duration
+	keyspace            bool
+
+	// ready is set to 1 while redis is reachable, accessed atomically.
+	ready int32
+
+	started time.Time
 }
 
 func (d *Dispatcher) Run() error {
-	client := redis.NewClient(&redis.Options{
-		Addr: d.redisAddr,
-	})
+	log.WithFields(log.Fields{
+		"addr":     d.redisAddr,
+		"upstream": d.upstream.String(),
+	}).Debug("connecting to redis")
 
-	_, err := client.Ping().Result()
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Error("error while connecting to redis")
-		return err
-	}
+	client := redis.NewClient(d.upstream.redisOptions(d.redisAddr))
+	go d.monitor(client)
 
-	client.Close()
+	go d.watch.run(d.ctx)
+	if d.keyspace {
+		go d.watch.keyspace(d.ctx, client, d.cache)
+	}
 
 	for i := 0; i < d.maxWorkers; i++ {
-		w, err := newWorker(d.redisAddr, d.cache, d.workers)
+		w, err := newWorker(d.redisAddr, d.upstream, d.cache, d.scripts, d.workers)
 		if err != nil {
 			return err
 		}
@@ -61,9 +88,19 @@ func (d *Dispatcher) Run() error {
 		"workers": d.maxWorkers,
 	}).Debug("pool of workers started")
 
-	d.srv.Handler = httpHandler(d)
+	d.srv.Handler = newRouter(d)
+	if d.h2c {
+		d.srv.Handler = serveH2C(d.srv.Handler, d.h2s)
+	}
 	go func() {
-		if err := d.srv.ListenAndServe(); err != nil {
+		var err error
+		if d.srv.TLSConfig != nil {
+			err = d.srv.ListenAndServeTLS("", "")
+		} else {
+			err = d.srv.ListenAndServe()
+		}
+
+		if err != nil {
 			log.WithFields(log.Fields{
 				"error": err,
 			}).Error("error starting server")
@@ -72,6 +109,14 @@ func (d *Dispatcher) Run() error {
 	}()
 
 	d.redisSrv.Handler = redisHandler(d)
+	d.redisSrv.Exec = execHandler(d)
+	d.redisSrv.Users = d.users
+	d.redisSrv.Info = d.info
+	d.redisSrv.PubSub = newRedisHub(client, d.pubsubConns, d.pubsubBuffer)
+	d.redisSrv.DB = d.upstream.DB
+	d.redisSrv.Databases = d.upstream.Databases
+	d.redisSrv.Tx = newTxPool(d.redisAddr, d.upstream, d.maxTx).open
+	d.redisSrv.Invalidate = func(db int, args []string) { invalidateCommand(d.cache, db, args) }
 	go func() {
 		if err := d.redisSrv.ListenAndServe(); err != nil {
 			log.WithFields(log.Fields{
@@ -92,34 +137,112 @@ func (d *Dispatcher) dispatch() {
 			return
 		case job := <-d.jobs:
 			go func(job Job) {
-				worker := <-d.workers
-				worker <- job
+				select {
+				case worker := <-d.workers:
+					worker <- job
+				case <-job.ctx.Done():
+				}
 			}(job)
 		}
 	}
 }
 
-func redisHandler(d *Dispatcher) func(string) (string, error) {
-	return func(key string) (string, error) {
-		work := Job{
-			res: make(chan *response),
-			key: key,
+// requestContext derives the context bounding a single request, covering
+// both the time spent queued and the time spent querying redis.
+func (d *Dispatcher) requestContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if d.requestTimeout > 0 {
+		return context.WithTimeout(parent, d.requestTimeout)
+	}
+
+	return context.WithCancel(parent)
+}
+
+// enqueue queues the job, failing right away if the queue is full.
+func (d *Dispatcher) enqueue(job Job) error {
+	select {
+	case d.jobs <- job:
+		return nil
+	default:
+		return errUnavailable
+	}
+}
+
+// submit queues the job and waits for its response.
+func (d *Dispatcher) submit(job Job) (*response, error) {
+	if err := d.enqueue(job); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-job.res:
+		return res, nil
+	case <-job.ctx.Done():
+		return nil, job.ctx.Err()
+	}
+}
+
+func redisHandler(d *Dispatcher) func(int, string) (string, error) {
+	return func(db int, key string) (string, error) {
+		ctx, cancel := d.requestContext(context.Background())
+		defer cancel()
+
+		job := newJob(ctx, key)
+		job.db = db
+
+		res, err := d.submit(job)
+		if err != nil {
+			return "", err
 		}
 
-		select {
-		case d.jobs <- work:
-			res := <-work.res
-			if res.code == http.StatusNotFound {
-				return "", errors.New("key not found")
-			}
+		if res.err != nil {
+			return "", res.err
+		}
 
-			return res.body, nil
-		default:
-			return "", errors.New("service unavailable")
+		if res.code != http.StatusOK {
+			return "", redis.Nil
 		}
+
+		return res.body, nil
 	}
 }
 
+// execHandler runs commands other than GET for the redis server.
+func execHandler(d *Dispatcher) func(int, []string) (interface{}, error) {
+	return func(db int, args []string) (interface{}, error) {
+		ctx, cancel := d.requestContext(context.Background())
+		defer cancel()
+
+		job := newCmdJob(ctx, args[0], args[1:]...)
+		job.db = db
+
+		res, err := d.submit(job)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.err != nil {
+			return nil, res.err
+		}
+
+		return res.val, nil
+	}
+}
+
+func newRouter(d *Dispatcher) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/ready", readyHandler(d))
+	mux.Handle("/mget", mgetHandler(d))
+	mux.Handle("/keys", listKeysHandler(d))
+	mux.Handle("/keys/", keysHandler(d))
+	mux.Handle("/cmd", cmdHandler(d))
+	mux.Handle("/watch", watchHandler(d))
+	mux.Handle("/", httpHandler(d))
+
+	return mux
+}
+
+// httpHandler serves GET /?key=k00, kept for compatibility with clients
+// predating /keys/, and commands in the GET /CMD/arg1/arg2 form.
 func httpHandler(d *Dispatcher) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
@@ -127,30 +250,31 @@ func httpHandler(d *Dispatcher) http.Handler {
 			return
 		}
 
+		if isPathCommand(r.URL.Path) {
+			pathCommand(d, w, r)
+			return
+		}
+
 		key := r.FormValue("key")
 		if key == "" {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		work := Job{
-			res: make(chan *response),
-			key: key,
-		}
-
-		select {
-		case d.jobs <- work:
-			res := <-work.res
-			w.WriteHeader(res.code)
-			fmt.Fprint(w, res.body)
-			return
-		default:
-			w.WriteHeader(http.StatusServiceUnavailable)
-			return
-		}
+		getKey(d, w, r, key)
 	})
 }
 
+// Reload reloads the TLS certificates from disk. Existing connections are
+// kept, new ones use the new certificates.
+func (d *Dispatcher) Reload() error {
+	if d.certs == nil {
+		return nil
+	}
+
+	return d.certs.reload()
+}
+
 func (d *Dispatcher) Shutdown(ctx context.Context) error {
 	if ctx == nil {
 		panic("ctx must be provided")
@@ -180,7 +304,7 @@ func (d *Dispatcher) Shutdown(ctx context.Context) error {
 	}
 }
 
-func NewDispatcher(port string, redisAddr string, redisServerPort string, maxJobs uint, maxWorkers uint, cacheCap int, exp time.Duration, errs chan<- error) (*Dispatcher, error) {
+func NewDispatcher(port string, redisAddr string, redisServerPort string, maxJobs uint, maxWorkers uint, cacheCap int, exp time.Duration, opts Options, errs chan<- error) (*Dispatcher, error) {
 	redisSrv := &redisServer{
 		Addr: net.JoinHostPort("", redisServerPort),
 	}
@@ -189,18 +313,79 @@ func NewDispatcher(port string, redisAddr string, redisServerPort string, maxJob
 		Addr: net.JoinHostPort("", port),
 	}
 
+	var u *users
+	if opts.UsersFile != "" {
+		var err error
+		u, err = loadUsers(opts.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := opts.Upstream.loadTLS(redisAddr); err != nil {
+		return nil, err
+	}
+
+	var certs *certReloader
+	if opts.TLS.enabled() {
+		var err error
+		certs, err = newCertReloader(opts.TLS)
+		if err != nil {
+			return nil, err
+		}
+
+		redisSrv.TLSConfig = certs.tlsConfig()
+		srv.TLSConfig = certs.tlsConfig()
+		srv.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	h2s, err := configureHTTP2(srv, int(maxJobs))
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	wCtx, wCancel := context.WithCancel(context.Background())
 
 	workers := make(chan chan Job, maxWorkers)
 	jobs := make(chan Job, maxJobs)
 
-	return &Dispatcher{
+	maxBatch := opts.MaxBatchSize
+	if maxBatch <= 0 {
+		maxBatch = defaultMaxBatchSize
+	}
+
+	compressMinSize := opts.CompressMinSize
+	if compressMinSize == 0 {
+		compressMinSize = defaultCompressMinSize
+	}
+
+	watchHeartbeat := opts.WatchHeartbeat
+	if watchHeartbeat <= 0 {
+		watchHeartbeat = defaultWatchHeartbeat
+	}
+
+	d := &Dispatcher{
 		redisAddr: redisAddr,
 
+		requestTimeout:      opts.RequestTimeout,
+		healthCheckInterval: opts.HealthCheckInterval,
+		upstream:            opts.Upstream,
+		pubsubConns:         opts.PubSubConnections,
+		pubsubBuffer:        opts.PubSubBuffer,
+		maxTx:               opts.MaxTransactions,
+		maxBatch:            maxBatch,
+		contentTypes:        opts.ContentTypes,
+		compressMinSize:     compressMinSize,
+		watchHeartbeat:      watchHeartbeat,
+		keyspace:            opts.KeyspaceNotifications,
+
 		cache:      newCache(cacheCap, exp, int(maxWorkers)),
+		scripts:    newScripts(opts.CacheableScripts),
 		maxWorkers: int(maxWorkers),
 		workers:    workers,
+		users:      u,
+		certs:      certs,
 
 		jobs: jobs,
 
@@ -212,5 +397,28 @@ func NewDispatcher(port string, redisAddr string, redisServerPort string, maxJob
 
 		redisSrv: redisSrv,
 		srv:      srv,
-	}, nil
+		h2s:      h2s,
+		h2c:      opts.H2C,
+
+		started: time.Now(),
+	}
+
+	d.watch = newWatchHub(opts.Upstream.DB, d.fetchWatched, opts.WatchBuffer, opts.WatchMaxClients, opts.WatchMaxKeys)
+	if !d.keyspace {
+		d.cache.changed = d.watch.changed
+	}
+	d.cache.flushed = d.watch.flushed
+
+	return d, nil
+}
+
+// fetchWatched reads the new value of a watched key.
+func (d *Dispatcher) fetchWatched(key string) (*response, error) {
+	ctx, cancel := d.requestContext(d.ctx)
+	defer cancel()
+
+	job := newJob(ctx, key)
+	job.db = d.upstream.DB
+
+	return d.submit(job)
 }
@@ -2,15 +2,20 @@ package proxy
 
 import (
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/go-redis/redis"
 	"github.com/stretchr/testify/suite"
 )
@@ -68,6 +73,7 @@ func (s *SuiteHTTPDispatcher) SetupSuite() {
 		maxWorkers: maxWorkers,
 		workers:    workers,
 		jobs:       jobs,
+		maxBatch:   defaultMaxBatchSize,
 
 		wCtx:    wCtx,
 		wCancel: wCancel,
@@ -76,7 +82,7 @@ func (s *SuiteHTTPDispatcher) SetupSuite() {
 	}
 
 	for i := 0; i < maxWorkers; i++ {
-		w, err := newWorker(redisAddr, cache, workers)
+		w, err := newWorker(redisAddr, UpstreamOptions{}, cache, newScripts(nil), workers)
 		if err != nil {
 			s.FailNow("error starting worker", err)
 		}
@@ -129,6 +135,485 @@ func (s *SuiteHTTPDispatcher) TestMissingKey() {
 	s.Equal("", string(body), "HTTP response should be empty")
 }
 
+func (s *SuiteHTTPDispatcher) TestMGet() {
+	ts := httptest.NewServer(mgetHandler(s.d))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/mget?key=k00&key=k01")
+	if err != nil {
+		s.FailNow("error making request", err)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	s.Equal(http.StatusOK, res.StatusCode, "should be 200")
+	s.JSONEq(`{"k00": "v00", "k01": null}`, string(body), "HTTP response should map keys to values")
+
+	if err := s.c.Set("bin", "\xff\xfe", 0).Err(); err != nil {
+		s.FailNow("error setting up redis", err)
+	}
+	defer s.c.Del("bin")
+
+	res, err = http.Get(ts.URL + "/mget?key=bin")
+	if err != nil {
+		s.FailNow("error making request", err)
+	}
+
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	s.JSONEq(`{"bin": {"base64": "//4="}}`, string(body), "values that aren't UTF-8 should be base64 encoded")
+}
+
+func (s *SuiteHTTPDispatcher) TestPostMGet() {
+	ts := httptest.NewServer(mgetHandler(s.d))
+	defer ts.Close()
+
+	post := func(body string, accept string) (*http.Response, string) {
+		req, err := http.NewRequest("POST", ts.URL+"/mget", strings.NewReader(body))
+		if err != nil {
+			s.FailNow("error creating request", err)
+		}
+		req.Header.Set("Accept", accept)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			s.FailNow("error making request", err)
+		}
+
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		return res, string(b)
+	}
+
+	res, body := post(`["k00", "k01"]`, "application/json")
+	s.Equal(http.StatusOK, res.StatusCode, "should be 200")
+	s.JSONEq(`{"k00": "v00", "k01": null}`, body, "HTTP response should map keys to values")
+
+	res, body = post(`["k01", "k00"]`, ndjsonType)
+	s.Equal(http.StatusOK, res.StatusCode, "should be 200")
+	s.Equal(ndjsonType, res.Header.Get("Content-Type"))
+
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	if s.Len(lines, 2, "each key should have its own line") {
+		s.JSONEq(`{"key": "k00", "value": "v00"}`, lines[0], "cached keys should be written first")
+		s.JSONEq(`{"key": "k01", "value": null}`, lines[1])
+	}
+
+	if err := s.c.Set("bin", "\xff\xfe", 0).Err(); err != nil {
+		s.FailNow("error setting up redis", err)
+	}
+	defer s.c.Del("bin")
+
+	_, body = post(`["bin"]`, "application/json")
+	s.JSONEq(`{"bin": {"base64": "//4="}}`, body, "values that aren't UTF-8 should be base64 encoded")
+
+	_, body = post(`["bin"]`, ndjsonType)
+	s.JSONEq(`{"key": "bin", "value": {"base64": "//4="}}`, strings.TrimSpace(body))
+
+	res, _ = post(`{"key": "k00"}`, "")
+	s.Equal(http.StatusBadRequest, res.StatusCode, "keys should be a JSON array")
+
+	keys := make([]string, defaultMaxBatchSize+1)
+	for i := range keys {
+		keys[i] = `"k00"`
+	}
+
+	res, _ = post("["+strings.Join(keys, ",")+"]", "")
+	s.Equal(http.StatusRequestEntityTooLarge, res.StatusCode, "batches over the max size should be 413")
+}
+
+func (s *SuiteHTTPDispatcher) TestCmd() {
+	ts := httptest.NewServer(newRouter(s.d))
+	defer ts.Close()
+
+	do := func(method, path, body string) (int, string) {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			s.FailNow("error creating request", err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			s.FailNow("error making request", err)
+		}
+
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		return res.StatusCode, string(b)
+	}
+
+	code, body := do("POST", "/cmd", `["RPUSH", "list:1", "\u00e9"]`)
+	s.Equal(http.StatusOK, code, "should be 200")
+	s.JSONEq(`{"RPUSH": 1}`, body, "integers should be numbers")
+
+	code, body = do("POST", "/cmd", `["RPUSH", "list:1", 30]`)
+	s.Equal(http.StatusOK, code, "numbers should be accepted as arguments")
+
+	code, body = do("GET", "/LRANGE/list%3A1/0/-1", "")
+	s.Equal(http.StatusOK, code, "should be 200")
+	s.JSONEq(`{"LRANGE": ["\u00e9", "30"]}`, body, "arrays should be arrays")
+
+	code, body = do("GET", "/GET/k00", "")
+	s.JSONEq(`{"GET": "v00"}`, body)
+
+	code, body = do("GET", "/GET/k01", "")
+	s.JSONEq(`{"GET": null}`, body, "missing keys should be null")
+
+	s.c.Set("bin", "\xff\xfe", 0)
+	code, body = do("POST", "/cmd", `["get", "bin"]`)
+	s.JSONEq(`{"GET": {"base64": "//4="}}`, body, "binary values should be base64")
+
+	code, body = do("POST", "/cmd", `["INCR", "list:1"]`)
+	s.Equal(http.StatusBadRequest, code, "errors replied by redis should be 400")
+	s.Contains(body, "WRONGTYPE")
+
+	code, body = do("GET", "/anything?key=k00", "")
+	s.Equal("v00", body, "paths that aren't commands should read the key")
+
+	code, _ = do("GET", "/favicon.ico", "")
+	s.Equal(http.StatusBadRequest, code, "paths that aren't commands should need a key")
+
+	code, _ = do("GET", "/DEL/list%3A1", "")
+	s.Equal(http.StatusMethodNotAllowed, code, "writes should require POST")
+
+	code, _ = do("POST", "/cmd", `["MULTI"]`)
+	s.Equal(http.StatusBadRequest, code, "connection commands should be rejected")
+
+	code, _ = do("POST", "/cmd", `["DEL", "list:1", "bin"]`)
+	s.Equal(http.StatusOK, code)
+}
+
+func (s *SuiteHTTPDispatcher) TestCacheHeaders() {
+	s.c.Set("c00", "v00", 0)
+	defer s.c.Del("c00")
+
+	get := func(header ...string) *http.Response {
+		req, err := http.NewRequest("GET", s.getRequestURI("c00"), nil)
+		if err != nil {
+			s.FailNow("error creating request", err)
+		}
+
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			s.FailNow("error making request", err)
+		}
+		res.Body.Close()
+
+		return res
+	}
+
+	res := get()
+	s.Equal("MISS", res.Header.Get("X-Cache"), "the first read should be a miss")
+	s.Equal("max-age=0", res.Header.Get("Cache-Control"), "max-age should be the time left in the cache")
+	s.Equal("0", res.Header.Get("Age"))
+
+	etag := res.Header.Get("ETag")
+	s.NotEmpty(etag, "replies should have an ETag")
+
+	<-time.After(time.Millisecond * 5)
+	res = get()
+	s.Equal("HIT", res.Header.Get("X-Cache"), "the second read should be a hit")
+	s.Equal(etag, res.Header.Get("ETag"), "the ETag should only depend on the value")
+
+	res = get("If-None-Match", etag)
+	s.Equal(http.StatusNotModified, res.StatusCode, "matching ETags should be 304")
+
+	res = get("Cache-Control", "no-cache")
+	s.Equal("MISS", res.Header.Get("X-Cache"), "no-cache should fetch from redis")
+
+	<-time.After(time.Millisecond * 150)
+	res = get("Cache-Control", "max-stale=60")
+	s.Equal("HIT", res.Header.Get("X-Cache"), "max-stale should accept expired values")
+
+	res = get()
+	s.Equal("MISS", res.Header.Get("X-Cache"), "expired values should be fetched again")
+}
+
+func (s *SuiteHTTPDispatcher) TestFormats() {
+	large := strings.Repeat("v", 2048)
+	s.c.Set("f00", "\x00\xff", 0)
+	s.c.Set("user:f01", `{"name": "jeloou"}`, 0)
+	s.c.Set("f02", large, 0)
+	defer s.c.Del("f00", "user:f01", "f02")
+
+	s.d.contentTypes = []ContentTypeRule{{"user:*", "application/json"}}
+	s.d.compressMinSize = 1024
+	defer func() {
+		s.d.contentTypes = nil
+		s.d.compressMinSize = 0
+	}()
+
+	get := func(key string, header ...string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", s.getRequestURI(key), nil)
+		if err != nil {
+			s.FailNow("error creating request", err)
+		}
+
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+
+		// the transport would decompress the body otherwise
+		res, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+		if err != nil {
+			s.FailNow("error making request", err)
+		}
+
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		return res, string(b)
+	}
+
+	res, body := get("f00")
+	s.Equal("application/octet-stream", res.Header.Get("Content-Type"), "binary values should be sniffed")
+	s.Equal("2", res.Header.Get("Content-Length"))
+	s.Equal("\x00\xff", body)
+
+	res, body = get("f00", "Accept", "application/json")
+	s.Equal("application/json", res.Header.Get("Content-Type"))
+	s.JSONEq(`{"key": "f00", "value": "AP8=", "encoding": "base64", "content_type": "application/octet-stream", "type": "string", "ttl": -1}`, body,
+		"JSON should wrap the value with its metadata")
+
+	res, body = get("f00", "Accept", "application/base64")
+	s.Equal("AP8=", body)
+
+	res, body = get("user:f01", "Accept", "application/json")
+	s.Equal("application/json", res.Header.Get("Content-Type"), "content types should be set by key pattern")
+	s.Equal(`{"name": "jeloou"}`, body, "JSON values should be served raw")
+
+	res, _ = get("user:f01", "Accept", "image/png")
+	s.Equal(http.StatusNotAcceptable, res.StatusCode)
+
+	res, body = get("f02", "Accept-Encoding", "gzip")
+	s.Equal("gzip", res.Header.Get("Content-Encoding"), "large values should be gzipped")
+	s.Equal(strconv.Itoa(len(body)), res.Header.Get("Content-Length"))
+	s.True(len(body) < len(large))
+
+	res, body = get("f02", "Accept-Encoding", "gzip, deflate, br")
+	s.Equal("br", res.Header.Get("Content-Encoding"), "brotli should be preferred to gzip")
+	b, _ := ioutil.ReadAll(brotli.NewReader(strings.NewReader(body)))
+	s.Equal(large, string(b))
+
+	res, _ = get("f00", "Accept-Encoding", "gzip")
+	s.Empty(res.Header.Get("Content-Encoding"), "small values shouldn't be compressed")
+}
+
+func (s *SuiteHTTPDispatcher) TestRange() {
+	s.c.Set("r00", "0123456789", 0)
+	defer s.c.Del("r00")
+
+	get := func(rng string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", s.getRequestURI("r00"), nil)
+		if err != nil {
+			s.FailNow("error creating request", err)
+		}
+		req.Header.Set("Range", rng)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			s.FailNow("error making request", err)
+		}
+
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		return res, string(b)
+	}
+
+	// once fetched from redis with GETRANGE, and once sliced from the cache
+	for _, source := range []string{"upstream", "cached"} {
+		res, body := get("bytes=2-4")
+		s.Equal(http.StatusPartialContent, res.StatusCode, source)
+		s.Equal("text/plain; charset=utf-8", res.Header.Get("Content-Type"), "ranges should be sniffed like the whole value")
+		s.Equal("bytes 2-4/10", res.Header.Get("Content-Range"), source)
+		s.Equal("234", body, source)
+
+		res, body = get("bytes=-3")
+		s.Equal("bytes 7-9/10", res.Header.Get("Content-Range"), source)
+		s.Equal("789", body, source)
+
+		http.Get(s.getRequestURI("r00"))
+		<-time.After(time.Millisecond * 5)
+	}
+
+	res, _ := get("bytes=20-")
+	s.Equal(http.StatusRequestedRangeNotSatisfiable, res.StatusCode)
+	s.Equal("bytes */10", res.Header.Get("Content-Range"))
+
+	res, body := get("bytes=0-1,4-5")
+	s.Equal(http.StatusOK, res.StatusCode, "multiple ranges should be ignored")
+	s.Equal("0123456789", body)
+}
+
+func (s *SuiteHTTPDispatcher) TestTypedKeys() {
+	ts := httptest.NewServer(newRouter(s.d))
+	defer ts.Close()
+
+	s.c.HSet("h00", "name", "jeloou")
+	s.c.RPush("l00", "a", "b", "c")
+	s.c.SAdd("s00", "a")
+	s.c.ZAdd("z00", redis.Z{Score: 1.5, Member: "a"}, redis.Z{Score: 2, Member: "b"})
+	defer s.c.Del("h00", "l00", "s00", "z00")
+
+	get := func(path string) (*http.Response, string) {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			s.FailNow("error making request", err)
+		}
+
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		return res, string(b)
+	}
+
+	res, body := get("/?key=h00")
+	s.Equal(http.StatusOK, res.StatusCode, "should be 200")
+	s.Equal("hash", res.Header.Get("X-Type"))
+	s.JSONEq(`{"name": "jeloou"}`, body, "hashes should be objects")
+
+	_, body = get("/keys/h00?field=name&field=age")
+	s.JSONEq(`{"name": "jeloou", "age": null}`, body, "fields should narrow hashes")
+
+	_, body = get("/?key=l00&start=1&stop=-1")
+	s.JSONEq(`["b", "c"]`, body, "start and stop should narrow lists")
+
+	_, body = get("/?key=s00")
+	s.JSONEq(`["a"]`, body, "sets should be arrays")
+
+	_, body = get("/?key=z00")
+	s.JSONEq(`[["a", 1.5], ["b", 2]]`, body, "sorted sets should be [member, score] pairs")
+
+	res, _ = get("/?key=l00&start=x")
+	s.Equal(http.StatusBadRequest, res.StatusCode, "invalid ranges should be 400")
+}
+
+func (s *SuiteHTTPDispatcher) TestListKeys() {
+	s.c.Set("ls:1", "v", 0)
+	s.c.Set("ls:2", "v", 0)
+	s.c.RPush("ls:3", "v")
+	defer s.c.Del("ls:1", "ls:2", "ls:3")
+
+	ts := httptest.NewServer(listKeysHandler(s.d))
+	defer ts.Close()
+
+	list := func(query string) (int, string, []string) {
+		res, err := http.Get(ts.URL + "/keys?" + query)
+		if err != nil {
+			s.FailNow("error making request", err)
+		}
+		defer res.Body.Close()
+
+		var page struct {
+			Cursor string
+			Keys   []string
+		}
+		json.NewDecoder(res.Body).Decode(&page)
+		sort.Strings(page.Keys)
+
+		return res.StatusCode, page.Cursor, page.Keys
+	}
+
+	var keys []string
+	cursor := ""
+	for {
+		code, next, page := list("match=ls:*&count=2&cursor=" + cursor)
+		s.Equal(http.StatusOK, code, "listing keys should be 200")
+
+		keys = append(keys, page...)
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	sort.Strings(keys)
+	s.Equal([]string{"ls:1", "ls:2", "ls:3"}, keys, "SCAN should list every matching key")
+
+	_, _, keys = list("match=ls:*&type=list")
+	s.Equal([]string{"ls:3"}, keys, "type should filter the keys")
+
+	// only the keys read through the proxy are cached
+	http.Get(s.getRequestURI("ls:1"))
+	http.Get(s.getRequestURI("ls:2"))
+	<-time.After(time.Millisecond * 5)
+
+	code, cursor, keys := list("source=cache&match=ls:*&count=1")
+	s.Equal(http.StatusOK, code)
+	s.Equal([]string{"ls:1"}, keys, "cached keys should be listed in order")
+	s.NotEmpty(cursor, "a cursor should be returned while keys are left")
+
+	_, cursor, keys = list("source=cache&match=ls:*&count=1&cursor=" + cursor)
+	s.Equal([]string{"ls:2"}, keys)
+	s.Empty(cursor, "no cursor should be returned after the last page")
+
+	code, _, _ = list("cursor=" + encodeCursor("cache", "ls:1"))
+	s.Equal(http.StatusBadRequest, code, "a cursor of another source should be 400")
+
+	code, _, _ = list("type=widget")
+	s.Equal(http.StatusBadRequest, code, "an unknown type should be 400")
+}
+
+func (s *SuiteHTTPDispatcher) TestKeys() {
+	ts := httptest.NewServer(keysHandler(s.d))
+	defer ts.Close()
+
+	do := func(method, path, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			s.FailNow("error creating request", err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			s.FailNow("error making request", err)
+		}
+
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		return res, string(b)
+	}
+
+	res, _ := do("PUT", "/keys/user%2F1?ttl=60", "v02")
+	s.Equal(http.StatusNoContent, res.StatusCode, "PUT should be 204")
+	s.Equal("v02", s.c.Get("user/1").Val(), "PUT should write the escaped key to redis")
+
+	<-time.After(time.Millisecond * 5)
+	s.Equal("v02", s.d.cache.get(dbKey(0, "user/1")), "PUT should update the cache")
+
+	res, body := do("GET", "/keys/user%2F1", "")
+	s.Equal(http.StatusOK, res.StatusCode, "GET should be 200")
+	s.Equal("v02", body, "GET should return the value")
+	s.Equal("60", res.Header.Get("X-TTL"), "GET should return the ttl set by PUT")
+
+	res, body = do("HEAD", "/keys/user%2F1", "")
+	s.Equal(http.StatusOK, res.StatusCode, "HEAD should be 200")
+	s.Equal("", body, "HEAD should have no body")
+
+	res, _ = do("PUT", "/keys/user%2F1?ttl=never", "v02")
+	s.Equal(http.StatusBadRequest, res.StatusCode, "invalid ttls should be 400")
+
+	res, _ = do("DELETE", "/keys/user%2F1", "")
+	s.Equal(http.StatusNoContent, res.StatusCode, "DELETE should be 204")
+
+	res, _ = do("DELETE", "/keys/user%2F1", "")
+	s.Equal(http.StatusNotFound, res.StatusCode, "DELETE of a missing key should be 404")
+
+	res, _ = do("GET", "/keys/user%2F1", "")
+	s.Equal(http.StatusNotFound, res.StatusCode, "deleted keys should be 404")
+
+	res, _ = do("POST", "/keys/user%2F1", "")
+	s.Equal(http.StatusMethodNotAllowed, res.StatusCode, "POST should be 405")
+}
+
 func (s *SuiteHTTPDispatcher) TearDownSuite() {
 	err := s.c.Del("k01").Err()
 	if err != nil {
@@ -206,6 +691,7 @@ func (s *SuiteRedisDispatcher) SetupSuite() {
 		maxWorkers: maxWorkers,
 		workers:    workers,
 		jobs:       jobs,
+		maxBatch:   defaultMaxBatchSize,
 
 		wCtx:    wCtx,
 		wCancel: wCancel,
@@ -214,7 +700,7 @@ func (s *SuiteRedisDispatcher) SetupSuite() {
 	}
 
 	// setting up worker
-	w, err := newWorker(redisAddr, cache, workers)
+	w, err := newWorker(redisAddr, UpstreamOptions{}, cache, newScripts(nil), workers)
 	if err != nil {
 		s.FailNow("error starting worker", err)
 	}
@@ -255,3 +741,46 @@ func (s *SuiteRedisDispatcher) TearDownSuite() {
 func TestRedisDispatcherSuite(t *testing.T) {
 	suite.Run(t, new(SuiteRedisDispatcher))
 }
+
+func TestReadyHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// nothing listens on port 1, so redis is never reachable
+	d := &Dispatcher{
+		ctx:                 ctx,
+		cancel:              cancel,
+		healthCheckInterval: time.Millisecond * 10,
+	}
+
+	go d.monitor(redis.NewClient(&redis.Options{
+		Addr: "127.0.0.1:1",
+	}))
+
+	ts := httptest.NewServer(newRouter(d))
+	defer ts.Close()
+
+	<-time.After(time.Millisecond * 50)
+
+	res, err := http.Get(ts.URL + "/ready")
+	if err != nil {
+		t.Fatal("error making request", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("should be 503 while redis is unreachable, got %d", res.StatusCode)
+	}
+
+	d.setReady(true)
+
+	res, err = http.Get(ts.URL + "/ready")
+	if err != nil {
+		t.Fatal("error making request", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("should be 200 once redis is reachable, got %d", res.StatusCode)
+	}
+}
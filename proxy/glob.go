@@ -0,0 +1,95 @@
+package proxy
+
+// globMatch reports whether s matches the redis style glob pattern. It
+// supports '*', '?', '[...]' classes with ranges and '^' negation, and '\'
+// escapes. Unlike path.Match, '*' also matches '/'.
+func globMatch(pattern string, s string) bool {
+	// every element but '*' matches a single byte, so after a mismatch it's
+	// enough to backtrack to the last '*', letting it match one more byte,
+	// which keeps matching linear in the length of s for each element
+	star, next := -1, 0
+	p, i := 0, 0
+	for i < len(s) || p < len(pattern) {
+		if p < len(pattern) {
+			switch c := pattern[p]; c {
+			case '*':
+				star, next = p, i
+				p++
+				continue
+			case '?':
+				if i < len(s) {
+					p++
+					i++
+					continue
+				}
+			case '[':
+				if i < len(s) {
+					if end, ok := matchClass(pattern[p:], s[i]); ok {
+						p += end
+						i++
+						continue
+					}
+				}
+			default:
+				if c == '\\' && p+1 < len(pattern) {
+					c = pattern[p+1]
+					p++
+				}
+
+				if i < len(s) && s[i] == c {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+
+		if star < 0 || next >= len(s) {
+			return false
+		}
+
+		next++
+		p, i = star+1, next
+	}
+
+	return true
+}
+
+// matchClass matches c against the class at the start of pattern, returning
+// the index right after the class.
+func matchClass(pattern string, c byte) (int, bool) {
+	i := 1
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+
+	matched := false
+	for ; i < len(pattern) && pattern[i] != ']'; i++ {
+		lo := pattern[i]
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+
+		hi := lo
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			i += 2
+		}
+
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+
+		if c >= lo && c <= hi {
+			matched = true
+		}
+	}
+
+	if i < len(pattern) {
+		i++
+	}
+
+	return i, matched != negate
+}
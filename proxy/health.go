@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHealthCheckInterval = time.Second
+
+	reconnectMinBackoff = time.Millisecond * 100
+	reconnectMaxBackoff = time.Second * 10
+)
+
+// Ready reports whether redis was reachable on the last health check.
+func (d *Dispatcher) Ready() bool {
+	return atomic.LoadInt32(&d.ready) == 1
+}
+
+// setReady updates the readiness state and reports whether it changed.
+func (d *Dispatcher) setReady(ready bool) bool {
+	var v int32
+	if ready {
+		v = 1
+	}
+
+	return atomic.SwapInt32(&d.ready, v) != v
+}
+
+// monitor pings redis until the dispatcher is stopped. While redis is down it
+// retries with backoff, once it's up it checks it every healthCheckInterval.
+func (d *Dispatcher) monitor(client *redis.Client) {
+	defer client.Close()
+
+	interval := d.healthCheckInterval
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	attempt := 0
+	for {
+		wait := interval
+
+		err := client.Ping().Err()
+		if err != nil {
+			attempt++
+			wait = reconnectMinBackoff + backoff(attempt, reconnectMinBackoff, reconnectMaxBackoff)
+
+			if d.setReady(false) || attempt == 1 {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Error("error while connecting to redis, proxy not ready")
+			}
+
+			log.WithFields(log.Fields{
+				"attempt": attempt,
+				"wait":    wait,
+			}).Debug("retrying connection to redis")
+		} else {
+			attempt = 0
+			if d.setReady(true) {
+				log.Info("connected to redis, proxy ready")
+			}
+		}
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func readyHandler(d *Dispatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !d.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
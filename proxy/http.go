@@ -0,0 +1,1042 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxValueLen is the largest value accepted by PUT /keys/{key}, the limit
+// of a string in redis.
+const maxValueLen = 512 << 20
+
+// statusCode maps the errors returned by Dispatcher.submit to a status.
+func statusCode(err error) int {
+	switch err {
+	case errUnavailable:
+		return http.StatusServiceUnavailable
+	case context.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// ndjsonType is the content type of streamed batch replies, one JSON
+// object per line.
+const ndjsonType = "application/x-ndjson"
+
+// mgetHandler serves GET /mget?key=k00&key=k01, replying with a JSON object
+// mapping each key to its value, or null if it doesn't exist, and POST /mget
+// taking the keys as a JSON array.
+func mgetHandler(d *Dispatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			getMGet(d, w, r)
+		case "POST":
+			postMGet(d, w, r)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func getMGet(d *Dispatcher, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	keys := r.Form["key"]
+	if len(keys) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if len(keys) > d.maxBatch {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if !authorize(d.users, w, r, "mget", keys...) {
+		return
+	}
+
+	ctx, cancel := d.requestContext(r.Context())
+	defer cancel()
+
+	job := newCmdJob(ctx, "mget", keys...)
+	job.db = d.upstream.DB
+
+	res, err := d.submit(job)
+	if err != nil {
+		w.WriteHeader(statusCode(err))
+		return
+	}
+
+	if res.err != nil {
+		w.WriteHeader(res.code)
+		return
+	}
+
+	vals := make(map[string]interface{}, len(keys))
+	for i, k := range keys {
+		vals[k] = replyJSON(res.val.([]interface{})[i])
+	}
+
+	writeJSON(w, http.StatusOK, vals)
+}
+
+// postMGet fetches the keys of the JSON array in the body, replying with a
+// JSON object mapping each key to its value, null, or {"error": "..."} if
+// it couldn't be fetched. With "Accept: application/x-ndjson" each result
+// is written as a line of its own as soon as it's known, cached keys first.
+func postMGet(d *Dispatcher, w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxValueLen)).Decode(&keys)
+	if err != nil || len(keys) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if len(keys) > d.maxBatch {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if !authorize(d.users, w, r, "mget", keys...) {
+		return
+	}
+
+	ctx, cancel := d.requestContext(r.Context())
+	defer cancel()
+
+	job := newCmdJob(ctx, "mget", keys...)
+	job.db = d.upstream.DB
+	job.items = make(chan item, len(keys))
+
+	if err := d.enqueue(job); err != nil {
+		w.WriteHeader(statusCode(err))
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Accept"), ndjsonType) {
+		vals := make(map[string]interface{}, len(keys))
+		receiveItems(ctx, job, func(it item) {
+			vals[keys[it.i]] = itemValue(it)
+		})
+
+		writeJSON(w, http.StatusOK, vals)
+		return
+	}
+
+	w.Header().Set("Content-Type", ndjsonType)
+	w.WriteHeader(http.StatusOK)
+
+	f, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	receiveItems(ctx, job, func(it item) {
+		line := map[string]interface{}{"key": keys[it.i]}
+		if it.err != nil {
+			line["error"] = it.err.Error()
+		} else {
+			line["value"] = replyJSON(it.val)
+		}
+
+		enc.Encode(line)
+		if f != nil {
+			f.Flush()
+		}
+	})
+}
+
+// receiveItems calls fn with each item of the job as it arrives. Keys
+// still pending when ctx is done are reported with its error.
+func receiveItems(ctx context.Context, job Job, fn func(item)) {
+	seen := make([]bool, len(job.args))
+	for n := 0; n < len(job.args); n++ {
+		select {
+		case it := <-job.items:
+			seen[it.i] = true
+			fn(it)
+		case <-ctx.Done():
+			for i := range seen {
+				if !seen[i] {
+					fn(item{i, nil, ctx.Err()})
+				}
+			}
+			return
+		}
+	}
+}
+
+// itemValue is how an item of a batch is represented in JSON.
+func itemValue(it item) interface{} {
+	if it.err != nil {
+		return map[string]string{"error": it.err.Error()}
+	}
+
+	return replyJSON(it.val)
+}
+
+// keysHandler serves the keys as resources under /keys/{key}:
+//
+//	GET, HEAD  read the key, like GET /?key=
+//	PUT        sets the key to the request body, with an optional ttl in
+//	           seconds given by the ttl query parameter or the X-TTL header
+//	DELETE     deletes the key
+//
+// The key is the rest of the path, unescaped, so keys with slashes or other
+// reserved characters have to be escaped, e.g. /keys/user%2F1.
+func keysHandler(d *Dispatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/keys/"))
+		if err != nil || key == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case "GET", "HEAD":
+			getKey(d, w, r, key)
+		case "PUT":
+			putKey(d, w, r, key)
+		case "DELETE":
+			deleteKey(d, w, r, key)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// getKey replies with the value of key, served from the cache if possible.
+func getKey(d *Dispatcher, w http.ResponseWriter, r *http.Request, key string) {
+	if !authorize(d.users, w, r, "get", key) {
+		return
+	}
+
+	if r.Method == "GET" && r.Header.Get("Range") != "" && getRange(d, w, r, key) {
+		return
+	}
+
+	ctx, cancel := d.requestContext(r.Context())
+	defer cancel()
+
+	job := newJob(ctx, key)
+	job.db = d.upstream.DB
+	cacheDirectives(r, &job)
+
+	res, err := d.submit(job)
+	if err != nil {
+		w.WriteHeader(statusCode(err))
+		return
+	}
+
+	if res.meta != nil {
+		setMetaHeaders(w.Header(), res.meta)
+	}
+
+	if res.err == errWrongType {
+		getTyped(d, w, r, key, res.meta.kind)
+		return
+	}
+
+	if res.code != http.StatusOK {
+		w.WriteHeader(res.code)
+		return
+	}
+
+	raw := contentType(d.contentTypes, key, []byte(res.body))
+
+	format, ok := negotiate(acceptHeader(r, raw), raw, formatJSON, formatBase64)
+	if !ok {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+
+	body, ctype := formatValue(format, key, res.body, raw, res.meta)
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Vary", "Accept")
+	if format == raw {
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+
+	writeCached(d, w, r, res, body)
+}
+
+// getRange serves the range of bytes of a string key asked for by the Range
+// header with a 206, slicing the cached value or running GETRANGE upstream
+// so large values aren't fetched whole. It reports false when the range
+// doesn't apply, e.g. the key isn't a string or the client asked for another
+// representation of the value, the whole value being served instead.
+func getRange(d *Dispatcher, w http.ResponseWriter, r *http.Request, key string) bool {
+	// there's no validator to check If-Range against without the value
+	if r.Header.Get("If-Range") != "" {
+		return false
+	}
+
+	first, last, ok := parseRange(r.Header.Get("Range"))
+	if !ok {
+		return false
+	}
+
+	if !authorize(d.users, w, r, "getrange", key) {
+		return true
+	}
+
+	ctx, cancel := d.requestContext(r.Context())
+	defer cancel()
+
+	start, end := getrangeOffsets(first, last)
+	job := newRangeJob(ctx, key, start, end)
+	job.db = d.upstream.DB
+	cacheDirectives(r, &job)
+
+	res, err := d.submit(job)
+	if err != nil {
+		w.WriteHeader(statusCode(err))
+		return true
+	}
+
+	v, _ := res.val.(*valueRange)
+	if res.err != nil || v == nil || v.n == 0 {
+		return false
+	}
+
+	// the same content type as the whole value
+	raw := contentType(d.contentTypes, key, []byte(v.head))
+	if format, _ := negotiate(acceptHeader(r, raw), raw, formatJSON, formatBase64); format != raw {
+		return false
+	}
+
+	start, end, ok = resolveRange(first, last, v.n)
+	if !ok || v.part == "" {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", v.n))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", raw)
+	h.Set("Vary", "Accept")
+	h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, v.n))
+	h.Set("Content-Length", strconv.Itoa(len(v.part)))
+	h.Set("Accept-Ranges", "bytes")
+
+	w.WriteHeader(http.StatusPartialContent)
+	io.WriteString(w, v.part)
+	return true
+}
+
+// getTyped replies with a key other than a string as JSON: an object for
+// hashes, an array for lists and sets, and [member, score] pairs for sorted
+// sets. The field query parameter, which may be repeated, narrows a hash
+// to those fields, and start and stop narrow a list or sorted set to that
+// range. Replies are cached like those of the same commands on the redis
+// server.
+func getTyped(d *Dispatcher, w http.ResponseWriter, r *http.Request, key string, kind string) {
+	q := r.URL.Query()
+
+	start, stop := q.Get("start"), q.Get("stop")
+	if start == "" {
+		start = "0"
+	}
+	if stop == "" {
+		stop = "-1"
+	}
+
+	for _, n := range []string{start, stop} {
+		if _, err := strconv.ParseInt(n, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	var args []string
+	switch kind {
+	case "hash":
+		args = []string{"hgetall", key}
+		if fields := q["field"]; len(fields) > 0 {
+			args = append([]string{"hmget", key}, fields...)
+		}
+	case "list":
+		args = []string{"lrange", key, start, stop}
+	case "set":
+		args = []string{"smembers", key}
+	case "zset":
+		args = []string{"zrange", key, start, stop, "withscores"}
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	if !authorize(d.users, w, r, args[0], key) {
+		return
+	}
+
+	ctx, cancel := d.requestContext(r.Context())
+	defer cancel()
+
+	job := newCmdJob(ctx, args[0], args[1:]...)
+	job.db = d.upstream.DB
+	cacheDirectives(r, &job)
+
+	res, err := d.submit(job)
+	if err != nil {
+		w.WriteHeader(statusCode(err))
+		return
+	}
+
+	if res.err != nil {
+		w.WriteHeader(res.code)
+		return
+	}
+
+	vals, _ := res.val.([]interface{})
+
+	var v interface{} = vals
+	switch args[0] {
+	case "hgetall", "hmget":
+		v = pairsObject(vals, args[2:])
+	case "zrange":
+		v = scorePairs(vals)
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeCached(d, w, r, res, append(body, '\n'))
+}
+
+// pairsObject builds the object of a hash from the reply of HGETALL, or
+// from the reply of HMGET when fields are given.
+func pairsObject(vals []interface{}, fields []string) map[string]interface{} {
+	obj := make(map[string]interface{}, len(vals))
+	if len(fields) > 0 {
+		for i, f := range fields {
+			if i < len(vals) {
+				obj[f] = vals[i]
+			}
+		}
+		return obj
+	}
+
+	for i := 0; i+1 < len(vals); i += 2 {
+		f, _ := vals[i].(string)
+		obj[f] = vals[i+1]
+	}
+
+	return obj
+}
+
+// scorePairs turns the reply of ZRANGE WITHSCORES into [member, score]
+// pairs. Infinite scores, which JSON can't represent, are kept as strings.
+func scorePairs(vals []interface{}) [][]interface{} {
+	pairs := make([][]interface{}, 0, len(vals)/2)
+	for i := 0; i+1 < len(vals); i += 2 {
+		s, _ := vals[i+1].(string)
+		score, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsInf(score, 0) {
+			pairs = append(pairs, []interface{}{vals[i], s})
+			continue
+		}
+
+		pairs = append(pairs, []interface{}{vals[i], score})
+	}
+
+	return pairs
+}
+
+// putKey sets key to the body of the request, which also replaces the
+// cached value.
+func putKey(d *Dispatcher, w http.ResponseWriter, r *http.Request, key string) {
+	ttl := r.URL.Query().Get("ttl")
+	if ttl == "" {
+		ttl = r.Header.Get("X-TTL")
+	}
+
+	if ttl != "" {
+		if secs, err := strconv.ParseInt(ttl, 10, 64); err != nil || secs <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !authorize(d.users, w, r, "set", key) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxValueLen))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	args := []string{key, string(body)}
+	if ttl != "" {
+		args = append(args, "ex", ttl)
+	}
+
+	ctx, cancel := d.requestContext(r.Context())
+	defer cancel()
+
+	job := newCmdJob(ctx, "set", args...)
+	job.db = d.upstream.DB
+
+	res, err := d.submit(job)
+	if err != nil {
+		w.WriteHeader(statusCode(err))
+		return
+	}
+
+	if res.err != nil {
+		w.WriteHeader(res.code)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteKey deletes key, replying with a 404 if it didn't exist.
+func deleteKey(d *Dispatcher, w http.ResponseWriter, r *http.Request, key string) {
+	if !authorize(d.users, w, r, "del", key) {
+		return
+	}
+
+	ctx, cancel := d.requestContext(r.Context())
+	defer cancel()
+
+	job := newCmdJob(ctx, "del", key)
+	job.db = d.upstream.DB
+
+	res, err := d.submit(job)
+	if err != nil {
+		w.WriteHeader(statusCode(err))
+		return
+	}
+
+	if res.err != nil {
+		w.WriteHeader(res.code)
+		return
+	}
+
+	if n, _ := res.val.(int64); n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// defaultListCount is the number of keys listed by GET /keys when the count
+// query parameter isn't set.
+const defaultListCount = 100
+
+// keyTypes are the types the keys listed by GET /keys can be filtered by.
+var keyTypes = map[string]bool{
+	"string": true,
+	"list":   true,
+	"set":    true,
+	"zset":   true,
+	"hash":   true,
+	"stream": true,
+}
+
+// listKeysHandler serves GET /keys?match=user:*&count=100&cursor=..., listing
+// the keys in redis with SCAN, or those cached by the proxy with
+// source=cache. The reply holds a page of keys and the cursor of the next
+// one, empty once every key was listed:
+//
+//	{"cursor": "c2NhbjoxNw", "keys": ["user:1", "user:2"]}
+//
+// Like SCAN, a page may hold fewer keys than count, even none, and a key
+// may be listed more than once. The type query parameter only lists keys of
+// that type, which requires redis 6 unless listing the cache. Keys the user
+// can't access are left out.
+func listKeysHandler(d *Dispatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := r.URL.Query()
+		match, kind := q.Get("match"), q.Get("type")
+		if kind != "" && !keyTypes[kind] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		count := defaultListCount
+		if c := q.Get("count"); c != "" {
+			n, err := strconv.Atoi(c)
+			if err != nil || n <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			count = n
+		}
+
+		if count > d.maxBatch {
+			count = d.maxBatch
+		}
+
+		source := q.Get("source")
+		if source == "" {
+			source = "redis"
+		}
+
+		if source != "redis" && source != "cache" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		pos, ok := decodeCursor(q.Get("cursor"), source)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if !authorize(d.users, w, r, "scan") {
+			return
+		}
+
+		var keys []string
+		next := ""
+		if source == "cache" {
+			keys, pos = d.cache.keys(d.upstream.DB, match, kind, pos, count)
+			if pos != "" {
+				next = encodeCursor(source, pos)
+			}
+		} else {
+			var code int
+			keys, pos, code = scanKeys(d, r, pos, match, kind, count)
+			if code != http.StatusOK {
+				w.WriteHeader(code)
+				return
+			}
+
+			if pos != "0" {
+				next = encodeCursor(source, pos)
+			}
+		}
+
+		if d.users != nil {
+			usr := d.users.fromRequest(r)
+
+			allowed := keys[:0]
+			for _, k := range keys {
+				if usr.canAccess(k) {
+					allowed = append(allowed, k)
+				}
+			}
+			keys = allowed
+		}
+
+		list := make([]interface{}, len(keys))
+		for i, k := range keys {
+			list[i] = replyJSON(k)
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"cursor": next,
+			"keys":   list,
+		})
+	})
+}
+
+// scanKeys runs a single SCAN from the cursor pos, returning the keys found
+// and the cursor to continue from, along with the status of the request.
+func scanKeys(d *Dispatcher, r *http.Request, pos string, match string, kind string, count int) ([]string, string, int) {
+	if pos == "" {
+		pos = "0"
+	}
+
+	args := []string{pos, "count", strconv.Itoa(count)}
+	if match != "" {
+		args = append(args, "match", match)
+	}
+
+	if kind != "" {
+		args = append(args, "type", kind)
+	}
+
+	ctx, cancel := d.requestContext(r.Context())
+	defer cancel()
+
+	job := newCmdJob(ctx, "scan", args...)
+	job.db = d.upstream.DB
+
+	res, err := d.submit(job)
+	if err != nil {
+		return nil, "", statusCode(err)
+	}
+
+	if res.err != nil {
+		return nil, "", commandStatus(res)
+	}
+
+	reply, ok := res.val.([]interface{})
+	if !ok || len(reply) != 2 {
+		return nil, "", http.StatusBadGateway
+	}
+
+	next, _ := reply[0].(string)
+	found, _ := reply[1].([]interface{})
+
+	keys := make([]string, 0, len(found))
+	for _, k := range found {
+		if s, ok := k.(string); ok {
+			keys = append(keys, s)
+		}
+	}
+
+	return keys, next, http.StatusOK
+}
+
+// encodeCursor returns the opaque cursor of GET /keys resuming at pos, the
+// cursor of SCAN or the last key listed from the cache.
+func encodeCursor(source string, pos string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(source + ":" + pos))
+}
+
+// decodeCursor returns the position of a cursor returned by encodeCursor,
+// reporting false if it's invalid or was returned for another source. An
+// empty cursor starts from the beginning.
+func decodeCursor(cursor string, source string) (string, bool) {
+	if cursor == "" {
+		return "", true
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(b), source+":") {
+		return "", false
+	}
+
+	pos := string(b[len(source)+1:])
+	if source == "redis" {
+		if _, err := strconv.ParseUint(pos, 10, 64); err != nil {
+			return "", false
+		}
+	}
+
+	return pos, true
+}
+
+// cacheDirectives applies the Cache-Control directives of the request to
+// job: no-cache fetches the value from redis and max-stale accepts expired
+// cached values, for up to the given seconds if any.
+func cacheDirectives(r *http.Request, job *Job) {
+	if r.Header.Get("Pragma") == "no-cache" {
+		job.noCache = true
+	}
+
+	for _, dir := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		name, arg := strings.ToLower(strings.TrimSpace(dir)), ""
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name, arg = name[:i], strings.Trim(name[i+1:], `"`)
+		}
+
+		switch name {
+		case "no-cache":
+			job.noCache = true
+		case "max-stale":
+			job.maxStale = -1
+			if secs, err := strconv.ParseInt(arg, 10, 64); err == nil && secs >= 0 {
+				job.maxStale = time.Duration(secs) * time.Second
+			}
+		}
+	}
+}
+
+// writeCached writes body along with its ETag, whether it was served from
+// the cache and for how long it can be cached by the client, based on the
+// remaining time until it expires from rp's cache. A client that already
+// has the same value gets a 304 instead. Bodies larger than the dispatcher's
+// compressMinSize are compressed with brotli or gzip for clients accepting
+// either.
+func writeCached(d *Dispatcher, w http.ResponseWriter, r *http.Request, res *response, body []byte) {
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+
+	f := fnv.New64a()
+	f.Write(body)
+	etag := fmt.Sprintf(`"%016x"`, f.Sum64())
+
+	if d.compressMinSize > 0 && len(body) >= d.compressMinSize {
+		enc := acceptEncoding(r.Header.Get("Accept-Encoding"))
+		if z, ok := compressBody(body, enc); ok {
+			body = z
+			// each encoding of the value is a representation of its own
+			etag = etag[:len(etag)-1] + "-" + enc + `"`
+			h.Set("Content-Encoding", enc)
+		}
+	}
+
+	h.Set("ETag", etag)
+
+	h.Set("X-Cache", "MISS")
+	if res.hit {
+		h.Set("X-Cache", "HIT")
+	}
+
+	now := time.Now()
+	if !res.at.IsZero() {
+		h.Set("Age", strconv.FormatInt(int64(now.Sub(res.at)/time.Second), 10))
+	}
+
+	if !res.exp.IsZero() {
+		maxAge := int64(0)
+		if res.exp.After(now) {
+			maxAge = int64(res.exp.Sub(now) / time.Second)
+		}
+
+		cc := "max-age=" + strconv.FormatInt(maxAge, 10)
+		if d.users != nil {
+			// replies depend on who's asking when authentication is on
+			cc = "private, " + cc
+		}
+		h.Set("Cache-Control", cc)
+	}
+
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// etagMatch reports whether etag is in the If-None-Match header, using the
+// weak comparison.
+func etagMatch(header string, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setMetaHeaders exposes the type and remaining ttl in seconds of a key,
+// the TTL being -1 for keys that don't expire.
+func setMetaHeaders(h http.Header, meta *keyMeta) {
+	h.Set("X-Type", meta.kind)
+	h.Set("X-TTL", strconv.FormatInt(meta.ttlSeconds(time.Now()), 10))
+}
+
+// httpExcluded are the commands that only make sense on a connection of
+// their own, so they can't be run over HTTP.
+var httpExcluded = map[string]bool{
+	"auth":         true,
+	"hello":        true,
+	"quit":         true,
+	"client":       true,
+	"select":       true,
+	"info":         true,
+	"command":      true,
+	"subscribe":    true,
+	"psubscribe":   true,
+	"unsubscribe":  true,
+	"punsubscribe": true,
+	"watch":        true,
+	"unwatch":      true,
+	"multi":        true,
+	"exec":         true,
+	"discard":      true,
+}
+
+// cmdHandler serves POST /cmd, running the command in the JSON array of the
+// body, e.g. ["HGETALL", "user:1"]. Arguments may be strings or numbers.
+func cmdHandler(d *Dispatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var vals []interface{}
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxValueLen))
+		dec.UseNumber()
+
+		if err := dec.Decode(&vals); err != nil || len(vals) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "ERR the body must be a JSON array of arguments"})
+			return
+		}
+
+		args := make([]string, len(vals))
+		for i, v := range vals {
+			switch v := v.(type) {
+			case string:
+				args[i] = v
+			case json.Number:
+				args[i] = v.String()
+			default:
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "ERR arguments must be strings or numbers"})
+				return
+			}
+		}
+
+		runCommand(d, w, r, args)
+	})
+}
+
+// isPathCommand reports whether the first segment of path names a command,
+// other paths being served like / for compatibility.
+func isPathCommand(path string) bool {
+	name := strings.TrimPrefix(path, "/")
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		name = name[:i]
+	}
+
+	_, ok := commandTable[strings.ToLower(name)]
+	return ok
+}
+
+// pathCommand serves GET /CMD/arg1/arg2, each segment of the path being an
+// escaped argument. Commands that write have to use POST /cmd.
+func pathCommand(d *Dispatcher, w http.ResponseWriter, r *http.Request) {
+	var args []string
+	for _, seg := range strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/") {
+		arg, err := url.PathUnescape(seg)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		args = append(args, arg)
+	}
+
+	if spec := commandTable[strings.ToLower(args[0])]; spec.flags&(cmdWrite|cmdScript) != 0 {
+		w.Header().Set("Allow", "POST")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "ERR commands that write must be sent with POST /cmd"})
+		return
+	}
+
+	runCommand(d, w, r, args)
+}
+
+// runCommand runs args with the same rules as the redis server, replying
+// with {"CMD": reply} or {"error": "..."}.
+func runCommand(d *Dispatcher, w http.ResponseWriter, r *http.Request, args []string) {
+	name := strings.ToUpper(args[0])
+	args[0] = strings.ToLower(args[0])
+
+	spec, ok := commandTable[args[0]]
+	if !ok || httpExcluded[args[0]] {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("ERR unknown command '%s'", args[0])})
+		return
+	}
+
+	if !spec.validArity(len(args)) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("ERR wrong number of arguments for '%s' command", args[0])})
+		return
+	}
+
+	if !authorize(d.users, w, r, args[0], commandKeys(args)...) {
+		return
+	}
+
+	var v interface{}
+	switch args[0] {
+	case "ping":
+		v = "PONG"
+		if len(args) == 2 {
+			v = args[1]
+		}
+	case "echo":
+		v = args[1]
+	default:
+		ctx, cancel := d.requestContext(r.Context())
+		defer cancel()
+
+		job := newCmdJob(ctx, args[0], args[1:]...)
+		if args[0] == "get" {
+			job = newJob(ctx, args[1])
+		}
+		job.db = d.upstream.DB
+
+		res, err := d.submit(job)
+		if err != nil {
+			writeJSON(w, statusCode(err), map[string]string{"error": upstreamError(err)})
+			return
+		}
+
+		switch {
+		case args[0] == "get" && res.code == http.StatusNotFound:
+			v = nil
+		case res.err != nil:
+			writeJSON(w, commandStatus(res), map[string]string{"error": upstreamError(res.err)})
+			return
+		case args[0] == "get":
+			v = res.body
+		default:
+			v = res.val
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{name: replyJSON(v)})
+}
+
+// commandStatus maps the error of a command to a status: errors replied
+// by redis are the client's fault, unlike network errors or timeouts.
+func commandStatus(res *response) int {
+	err := res.err
+	if err == context.DeadlineExceeded || retryable(err) {
+		return res.code
+	}
+
+	if strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		return http.StatusNotFound
+	}
+
+	return http.StatusBadRequest
+}
+
+// replyJSON converts a reply as returned by go-redis to JSON. Bulk strings
+// that aren't valid UTF-8 are encoded as {"base64": "..."}.
+func replyJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if !utf8.ValidString(v) {
+			return map[string]string{"base64": base64.StdEncoding.EncodeToString([]byte(v))}
+		}
+		return v
+	case []interface{}:
+		vals := make([]interface{}, len(v))
+		for i, e := range v {
+			vals[i] = replyJSON(e)
+		}
+		return vals
+	case error:
+		return map[string]string{"error": v.Error()}
+	}
+
+	return v
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// configureHTTP2 returns the HTTP/2 server of srv, enabling HTTP/2 over TLS
+// when srv has a TLS config. Each stream is queued like a request of its own,
+// so a single connection is limited to maxStreams concurrent streams instead
+// of filling the queue by itself.
+func configureHTTP2(srv *http.Server, maxStreams int) (*http2.Server, error) {
+	h2s := &http2.Server{MaxConcurrentStreams: uint32(maxStreams)}
+
+	// ConfigureServer sets a TLS config when there's none, which would
+	// serve TLS without certificates
+	if srv.TLSConfig == nil {
+		return h2s, nil
+	}
+
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return nil, err
+	}
+
+	return h2s, nil
+}
+
+// serveH2C wraps h to also serve HTTP/2 without TLS, to clients with prior
+// knowledge and to clients upgrading an HTTP/1.1 connection with
+// Upgrade: h2c.
+func serveH2C(h http.Handler, h2s *http2.Server) http.Handler {
+	return h2c.NewHandler(h, h2s)
+}
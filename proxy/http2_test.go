@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// h2cClient speaks HTTP/2 without TLS, with prior knowledge.
+func h2cClient() *http.Client {
+	return &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+// newH2CServer starts a server for h, serving h2c with up to maxStreams
+// concurrent streams on a connection.
+func newH2CServer(h http.Handler, maxStreams int, connContext func(context.Context, net.Conn) context.Context) (*httptest.Server, error) {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config.ConnContext = connContext
+
+	h2s, err := configureHTTP2(ts.Config, maxStreams)
+	if err != nil {
+		return nil, err
+	}
+
+	ts.Config.Handler = serveH2C(h, h2s)
+	ts.Start()
+
+	return ts, nil
+}
+
+type streamsKey struct{}
+
+func TestH2C(t *testing.T) {
+	const streams = 4
+
+	var peak int32
+	release := make(chan struct{})
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		active := r.Context().Value(streamsKey{}).(*int32)
+		n := atomic.AddInt32(active, 1)
+		defer atomic.AddInt32(active, -1)
+
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+
+		<-release
+		w.Write([]byte(r.Proto))
+	})
+
+	// counts the streams in flight on each connection
+	ts, err := newH2CServer(h, streams/2, func(ctx context.Context, _ net.Conn) context.Context {
+		return context.WithValue(ctx, streamsKey{}, new(int32))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	c := h2cClient()
+
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res, err := c.Get(ts.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			if string(body) != "HTTP/2.0" {
+				t.Errorf("request should be served over HTTP/2, got %s", body)
+			}
+		}()
+	}
+
+	<-time.After(time.Millisecond * 100)
+	close(release)
+	wg.Wait()
+
+	if peak != streams/2 {
+		t.Errorf("expected up to %d concurrent streams on a connection, got %d", streams/2, peak)
+	}
+}
+
+func (s *SuiteHTTPDispatcher) TestH2C() {
+	ts, err := newH2CServer(newRouter(s.d), 10, nil)
+	if err != nil {
+		s.FailNow("error starting server", err)
+	}
+	defer ts.Close()
+
+	res, err := h2cClient().Get(ts.URL + "/keys/k00")
+	if err != nil {
+		s.FailNow("error making request", err)
+	}
+
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	s.Equal(2, res.ProtoMajor, "h2c should be served over HTTP/2")
+	s.Equal(http.StatusOK, res.StatusCode)
+	s.Equal("v00", string(body))
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+
+	ts, err := newH2CServer(h, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// an empty HTTP2-Settings header keeps the defaults
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n" +
+		"Host: " + ts.Listener.Addr().String() + "\r\n" +
+		"Connection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\n" +
+		"HTTP2-Settings: \r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected %d, got %d", http.StatusSwitchingProtocols, res.StatusCode)
+	}
+
+	if up := res.Header.Get("Upgrade"); up != "h2c" {
+		t.Errorf("expected an upgrade to h2c, got %q", up)
+	}
+
+	// the upgraded request is answered on stream 1
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		t.Fatal(err)
+	}
+
+	fr := http2.NewFramer(conn, br)
+	if err := fr.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if d, ok := f.(*http2.DataFrame); ok && d.StreamID == 1 {
+			if string(d.Data()) != "HTTP/2.0" {
+				t.Errorf("upgraded request should be served over HTTP/2, got %s", d.Data())
+			}
+			return
+		}
+	}
+}
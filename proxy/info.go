@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type infoField struct {
+	name  string
+	value string
+}
+
+// infoSection is a section of the INFO reply, e.g. "# Cache".
+type infoSection struct {
+	name   string
+	fields []infoField
+}
+
+func (s *infoSection) add(name string, v interface{}) {
+	var value string
+	switch v := v.(type) {
+	case string:
+		value = v
+	case int:
+		value = strconv.Itoa(v)
+	case int64:
+		value = strconv.FormatInt(v, 10)
+	case bool:
+		value = "0"
+		if v {
+			value = "1"
+		}
+	}
+
+	s.fields = append(s.fields, infoField{name, value})
+}
+
+// sections returns the sections of the INFO reply, the proxy section
+// starting with the fields about the clients of the redis server.
+func (r *redisServer) sections() []infoSection {
+	r.mu.Lock()
+	clients := len(r.clients)
+	r.mu.Unlock()
+
+	proxy := infoSection{name: "Proxy"}
+	proxy.add("connected_clients", clients)
+	proxy.add("total_connections_received", atomic.LoadInt64(&r.connections))
+	proxy.add("total_commands_processed", atomic.LoadInt64(&r.commands))
+
+	if r.Info == nil {
+		return []infoSection{proxy}
+	}
+
+	rest := []infoSection{}
+	for _, s := range r.Info() {
+		if s.name == proxy.name {
+			proxy.fields = append(proxy.fields, s.fields...)
+			continue
+		}
+
+		rest = append(rest, s)
+	}
+
+	return append([]infoSection{proxy}, rest...)
+}
+
+// info handles INFO [section ...].
+func (r *redisServer) info(c *redisConn, args []string) {
+	all := len(args) == 1
+	want := make(map[string]bool)
+	for _, a := range args[1:] {
+		a = strings.ToLower(a)
+		if a == "all" || a == "default" || a == "everything" {
+			all = true
+		}
+		want[a] = true
+	}
+
+	var buf bytes.Buffer
+	for _, s := range r.sections() {
+		if !all && !want[strings.ToLower(s.name)] {
+			continue
+		}
+
+		if buf.Len() > 0 {
+			buf.WriteString("\r\n")
+		}
+
+		buf.WriteString("# " + s.name + "\r\n")
+		for _, f := range s.fields {
+			buf.WriteString(f.name + ":" + f.value + "\r\n")
+		}
+	}
+
+	c.writeBulk(buf.String())
+}
+
+// info returns the proxy, cache and upstream sections of INFO.
+func (d *Dispatcher) info() []infoSection {
+	idle := len(d.workers)
+
+	proxy := infoSection{name: "Proxy"}
+	proxy.add("uptime_in_seconds", int64(time.Since(d.started)/time.Second))
+	proxy.add("workers", d.maxWorkers)
+	proxy.add("busy_workers", d.maxWorkers-idle)
+	proxy.add("queue_depth", len(d.jobs))
+	proxy.add("queue_capacity", cap(d.jobs))
+
+	c := infoSection{name: "Cache"}
+	c.add("keys", d.cache.len())
+	c.add("capacity", d.cache.cap)
+	c.add("expiry_ms", int64(d.cache.exp/time.Millisecond))
+	c.add("hits", atomic.LoadInt64(&d.cache.hits))
+	c.add("misses", atomic.LoadInt64(&d.cache.misses))
+	c.add("evictions", atomic.LoadInt64(&d.cache.evictions))
+
+	status := "down"
+	if d.Ready() {
+		status = "up"
+	}
+
+	upstream := infoSection{name: "Upstream"}
+	upstream.add("addr", d.redisAddr)
+	upstream.add("link_status", status)
+	upstream.add("tls", d.upstream.tlsEnabled())
+	upstream.add("db", d.upstream.DB)
+
+	return []infoSection{proxy, c, upstream}
+}
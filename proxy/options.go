@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const redacted = "[redacted]"
+
+// Options holds the optional settings of a Dispatcher.
+type Options struct {
+	// RequestTimeout bounds the time a request can spend waiting for a
+	// worker and talking to redis. Zero means no deadline.
+	RequestTimeout time.Duration
+
+	// HealthCheckInterval is how often redis is pinged once connected.
+	HealthCheckInterval time.Duration
+
+	// UsersFile is a JSON file with the users allowed to use the proxy
+	// and their ACLs. When empty no authentication is required.
+	UsersFile string
+
+	// TLS enables TLS on both listeners when a certificate is set.
+	TLS TLSOptions
+
+	// CacheableScripts maps the SHA of read only Lua scripts to the ttl
+	// of their cached results.
+	CacheableScripts map[string]time.Duration
+
+	// PubSubConnections is the number of upstream connections the
+	// subscriptions of all clients are spread over.
+	PubSubConnections int
+
+	// PubSubBuffer is the number of messages queued for a subscribed
+	// client before it's disconnected for being too slow.
+	PubSubBuffer int
+
+	// MaxTransactions is the max number of clients pinned to an upstream
+	// connection by WATCH or MULTI at once.
+	MaxTransactions int
+
+	// MaxBatchSize is the max number of keys of a single MGET over HTTP.
+	MaxBatchSize int
+
+	// ContentTypes sets the content type of the values of keys matching
+	// a pattern over HTTP, the first matching rule winning. Values of
+	// other keys have their type sniffed.
+	ContentTypes []ContentTypeRule
+
+	// CompressMinSize is the size from which HTTP replies are compressed, a
+	// negative value disables compression.
+	CompressMinSize int
+
+	// WatchHeartbeat is how often idle clients watching keys are sent a
+	// heartbeat.
+	WatchHeartbeat time.Duration
+
+	// WatchBuffer is the number of events kept for watching clients to
+	// resume from after reconnecting.
+	WatchBuffer int
+
+	// WatchMaxClients and WatchMaxKeys bound the clients watching keys
+	// and the keys and patterns each of them watches.
+	WatchMaxClients int
+	WatchMaxKeys    int
+
+	// KeyspaceNotifications watches the changes made to keys by other
+	// redis clients too, through keyspace notifications, which have to
+	// be enabled in redis.
+	KeyspaceNotifications bool
+
+	// H2C serves HTTP/2 without TLS to clients with prior knowledge or
+	// upgrading with Upgrade: h2c.
+	// HTTP/2 is always served over TLS.
+	H2C bool
+
+	Upstream UpstreamOptions
+}
+
+// UpstreamOptions configures the connections opened to the upstream redis.
+// Zero values fall back to the go-redis defaults.
+type UpstreamOptions struct {
+	// Username is sent along with Password for redis ACL users. Leave
+	// empty to authenticate with Password only.
+	Username string
+	Password string
+	DB       int
+	// Databases is the number of databases of the redis server, as set
+	// by its databases directive.
+	Databases int
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	PoolSize           int
+	PoolTimeout        time.Duration
+	IdleTimeout        time.Duration
+	IdleCheckFrequency time.Duration
+
+	// MaxRetries is the number of times an idempotent read is retried
+	// after a network error, waiting between MinRetryBackoff and
+	// MaxRetryBackoff.
+	MaxRetries      int
+	MinRetryBackoff time.Duration
+	MaxRetryBackoff time.Duration
+
+	// TLS enables TLS, it's implied by any of the other TLS options.
+	TLS                   bool
+	TLSCAFile             string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool
+
+	tlsConfig *tls.Config
+}
+
+func (o *UpstreamOptions) tlsEnabled() bool {
+	return o.TLS || o.TLSCAFile != "" || o.TLSCertFile != "" || o.TLSServerName != "" || o.TLSInsecureSkipVerify
+}
+
+// loadTLS builds the TLS config shared by every connection to redis. The
+// server name defaults to the host of addr.
+func (o *UpstreamOptions) loadTLS(addr string) error {
+	if !o.tlsEnabled() {
+		return nil
+	}
+
+	cfg := &tls.Config{
+		ServerName:         o.TLSServerName,
+		InsecureSkipVerify: o.TLSInsecureSkipVerify,
+	}
+
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		cfg.ServerName = host
+	}
+
+	if o.TLSCAFile != "" {
+		pool, err := loadCertPool(o.TLSCAFile)
+		if err != nil {
+			return err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if o.TLSCertFile != "" || o.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.TLSCertFile, o.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("error loading redis tls certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	o.tlsConfig = cfg
+	return nil
+}
+
+// String describes the options without exposing the password, so they are
+// safe to log.
+func (o UpstreamOptions) String() string {
+	password := ""
+	if o.Password != "" {
+		password = redacted
+	}
+
+	return fmt.Sprintf("{Username:%s Password:%s DB:%d TLS:%v DialTimeout:%v ReadTimeout:%v WriteTimeout:%v PoolSize:%d MaxRetries:%d}",
+		o.Username, password, o.DB, o.tlsEnabled(), o.DialTimeout, o.ReadTimeout, o.WriteTimeout, o.PoolSize, o.MaxRetries)
+}
+
+func (o *UpstreamOptions) redisOptions(addr string) *redis.Options {
+	opts := &redis.Options{
+		Addr: addr,
+
+		Password: o.Password,
+		DB:       o.DB,
+
+		DialTimeout:  o.DialTimeout,
+		ReadTimeout:  o.ReadTimeout,
+		WriteTimeout: o.WriteTimeout,
+
+		PoolSize:           o.PoolSize,
+		PoolTimeout:        o.PoolTimeout,
+		IdleTimeout:        o.IdleTimeout,
+		IdleCheckFrequency: o.IdleCheckFrequency,
+
+		// retries are handled by the workers, only for reads
+		MaxRetries: 0,
+
+		TLSConfig: o.tlsConfig,
+	}
+
+	if o.Username != "" {
+		// go-redis only knows the single argument AUTH, and it would
+		// SELECT before authenticating, so both are done on connect.
+		opts.Password = ""
+		opts.DB = 0
+		opts.OnConnect = func(cn *redis.Conn) error {
+			err := cn.Process(redis.NewStatusCmd("auth", o.Username, o.Password))
+			if err != nil {
+				return err
+			}
+
+			if o.DB > 0 {
+				return cn.Select(o.DB).Err()
+			}
+
+			return nil
+		}
+	}
+
+	return opts
+}
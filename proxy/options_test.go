@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamOptionsRedacted(t *testing.T) {
+	o := UpstreamOptions{
+		Username: "rp",
+		Password: "s3cr3t",
+		DB:       3,
+	}
+
+	for _, s := range []string{o.String(), fmt.Sprintf("%v", o), fmt.Sprintf("%+v", o)} {
+		if strings.Contains(s, o.Password) {
+			t.Errorf("password should be redacted, got %s", s)
+		}
+	}
+}
+
+func TestUpstreamOptionsAuth(t *testing.T) {
+	o := UpstreamOptions{
+		Password: "s3cr3t",
+		DB:       3,
+	}
+
+	opts := o.redisOptions("localhost:6379")
+	if opts.Password != o.Password || opts.DB != o.DB || opts.OnConnect != nil {
+		t.Error("password and db should be set on the go-redis options")
+	}
+
+	o.Username = "rp"
+
+	opts = o.redisOptions("localhost:6379")
+	if opts.Password != "" || opts.DB != 0 || opts.OnConnect == nil {
+		t.Error("ACL users should authenticate and select the db on connect")
+	}
+}
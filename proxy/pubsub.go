@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPubSubConns  = 2
+	defaultPubSubBuffer = 1024
+)
+
+// pubsubConn is an upstream connection in subscribe mode, implemented by
+// *redis.PubSub which resubscribes on its own after reconnecting.
+type pubsubConn interface {
+	Subscribe(channels ...string) error
+	PSubscribe(patterns ...string) error
+	Unsubscribe(channels ...string) error
+	PUnsubscribe(patterns ...string) error
+	Channel() <-chan *redis.Message
+	Close() error
+}
+
+// subscriber is a downstream connection in subscribe mode. Messages are
+// queued in out and written by their own goroutine, a client too slow to
+// keep up with them is disconnected once out is full.
+type subscriber struct {
+	c   *redisConn
+	out chan []string
+
+	// channels and patterns are guarded by the hub's lock.
+	channels map[string]struct{}
+	patterns map[string]struct{}
+
+	done chan struct{}
+	once sync.Once
+}
+
+func newSubscriber(c *redisConn, buffer int) *subscriber {
+	return &subscriber{
+		c:        c,
+		out:      make(chan []string, buffer),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// run writes the queued messages until the subscriber is closed.
+func (s *subscriber) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg := <-s.out:
+			s.c.wmu.Lock()
+			s.c.writeReply(msg)
+			err := s.c.w.Flush()
+			s.c.wmu.Unlock()
+
+			if err != nil {
+				s.close()
+				return
+			}
+		}
+	}
+}
+
+// send queues msg without blocking, disconnecting the client if its buffer
+// is full.
+func (s *subscriber) send(msg []string) {
+	select {
+	case s.out <- msg:
+	default:
+		log.WithFields(log.Fields{
+			"addr":   s.c.conn.RemoteAddr(),
+			"buffer": cap(s.out),
+		}).Warn("pub/sub client too slow, disconnecting it")
+		s.close()
+	}
+}
+
+func (s *subscriber) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.c.conn.Close()
+	})
+}
+
+// count is the number of channels and patterns the client is subscribed
+// to, h.mu must be held.
+func (s *subscriber) count() int64 {
+	return int64(len(s.channels) + len(s.patterns))
+}
+
+// hub multiplexes the subscriptions of downstream clients over a few
+// upstream connections. Each channel or pattern is subscribed upstream
+// while at least one client is subscribed to it, and its messages are fanned
+// out to all of them.
+type hub struct {
+	conns  []pubsubConn
+	buffer int
+
+	mu       sync.Mutex
+	channels map[string]map[*subscriber]struct{}
+	patterns map[string]map[*subscriber]struct{}
+}
+
+func newHub(conns []pubsubConn, buffer int) *hub {
+	h := &hub{
+		conns:    conns,
+		buffer:   buffer,
+		channels: make(map[string]map[*subscriber]struct{}),
+		patterns: make(map[string]map[*subscriber]struct{}),
+	}
+
+	for _, conn := range conns {
+		go h.receive(conn)
+	}
+
+	return h
+}
+
+// newRedisHub opens n upstream subscriber connections with client.
+func newRedisHub(client *redis.Client, n int, buffer int) *hub {
+	if n <= 0 {
+		n = defaultPubSubConns
+	}
+
+	if buffer <= 0 {
+		buffer = defaultPubSubBuffer
+	}
+
+	conns := make([]pubsubConn, n)
+	for i := range conns {
+		conns[i] = client.Subscribe()
+	}
+
+	return newHub(conns, buffer)
+}
+
+// conn returns the upstream connection name is subscribed on.
+func (h *hub) conn(name string) pubsubConn {
+	f := fnv.New32a()
+	f.Write([]byte(name))
+
+	return h.conns[f.Sum32()%uint32(len(h.conns))]
+}
+
+func (h *hub) receive(conn pubsubConn) {
+	for msg := range conn.Channel() {
+		h.publish(msg)
+	}
+}
+
+func (h *hub) publish(msg *redis.Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if msg.Pattern != "" {
+		for s := range h.patterns[msg.Pattern] {
+			s.send([]string{"pmessage", msg.Pattern, msg.Channel, msg.Payload})
+		}
+		return
+	}
+
+	for s := range h.channels[msg.Channel] {
+		s.send([]string{"message", msg.Channel, msg.Payload})
+	}
+}
+
+// subscribe subscribes s to the given channels, or patterns, returning the
+// number of subscriptions of s after each one.
+func (h *hub) subscribe(s *subscriber, pattern bool, names ...string) ([]int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subs, own := h.channels, s.channels
+	if pattern {
+		subs, own = h.patterns, s.patterns
+	}
+
+	counts := make([]int64, 0, len(names))
+	for _, name := range names {
+		if _, ok := own[name]; !ok {
+			if len(subs[name]) == 0 {
+				conn := h.conn(name)
+
+				var err error
+				if pattern {
+					err = conn.PSubscribe(name)
+				} else {
+					err = conn.Subscribe(name)
+				}
+
+				if err != nil {
+					return counts, err
+				}
+
+				subs[name] = make(map[*subscriber]struct{})
+			}
+
+			subs[name][s] = struct{}{}
+			own[name] = struct{}{}
+		}
+
+		counts = append(counts, s.count())
+	}
+
+	return counts, nil
+}
+
+// unsubscribe unsubscribes s from the given channels, or patterns, or all
+// of them if none is given. It returns the names unsubscribed from and the
+// number of subscriptions of s left after each one.
+func (h *hub) unsubscribe(s *subscriber, pattern bool, names ...string) ([]string, []int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subs, own := h.channels, s.channels
+	if pattern {
+		subs, own = h.patterns, s.patterns
+	}
+
+	if len(names) == 0 {
+		for name := range own {
+			names = append(names, name)
+		}
+	}
+
+	counts := make([]int64, 0, len(names))
+	for _, name := range names {
+		if _, ok := own[name]; ok {
+			delete(own, name)
+			delete(subs[name], s)
+
+			if len(subs[name]) == 0 {
+				delete(subs, name)
+				h.release(name, pattern)
+			}
+		}
+
+		counts = append(counts, s.count())
+	}
+
+	return names, counts
+}
+
+// release unsubscribes upstream from a channel no client listens to.
+func (h *hub) release(name string, pattern bool) {
+	conn := h.conn(name)
+
+	var err error
+	if pattern {
+		err = conn.PUnsubscribe(name)
+	} else {
+		err = conn.Unsubscribe(name)
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"channel": name,
+			"error":   err,
+		}).Debug("error unsubscribing upstream")
+	}
+}
+
+// remove drops every subscription of a disconnected client.
+func (h *hub) remove(s *subscriber) {
+	h.unsubscribe(s, false)
+	h.unsubscribe(s, true)
+	s.close()
+}
+
+func (h *hub) Close() error {
+	for _, conn := range h.conns {
+		conn.Close()
+	}
+
+	return nil
+}
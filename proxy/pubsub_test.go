@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/suite"
+)
+
+// pubsubConnMock is an upstream subscriber connection counting the
+// subscriptions made on it.
+type pubsubConnMock struct {
+	mu   sync.Mutex
+	subs map[string]int
+	ch   chan *redis.Message
+}
+
+func newPubSubConnMock() *pubsubConnMock {
+	return &pubsubConnMock{
+		subs: make(map[string]int),
+		ch:   make(chan *redis.Message),
+	}
+}
+
+func (m *pubsubConnMock) add(n int, names ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, name := range names {
+		m.subs[name] += n
+	}
+	return nil
+}
+
+func (m *pubsubConnMock) count(name string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.subs[name]
+}
+
+func (m *pubsubConnMock) Subscribe(channels ...string) error    { return m.add(1, channels...) }
+func (m *pubsubConnMock) PSubscribe(patterns ...string) error   { return m.add(1, patterns...) }
+func (m *pubsubConnMock) Unsubscribe(channels ...string) error  { return m.add(-1, channels...) }
+func (m *pubsubConnMock) PUnsubscribe(patterns ...string) error { return m.add(-1, patterns...) }
+func (m *pubsubConnMock) Channel() <-chan *redis.Message        { return m.ch }
+func (m *pubsubConnMock) Close() error                          { return nil }
+
+type SuitePubSub struct {
+	suite.Suite
+
+	upstream *pubsubConnMock
+	rs       *redisServer
+}
+
+func (s *SuitePubSub) SetupTest() {
+	s.upstream = newPubSubConnMock()
+	s.rs = &redisServer{
+		PubSub: newHub([]pubsubConn{s.upstream}, 2),
+	}
+}
+
+// connect opens a client connection to the redis server.
+func (s *SuitePubSub) connect() (net.Conn, *bufio.Reader) {
+	client, server := net.Pipe()
+	go s.rs.handle(server)
+
+	return client, bufio.NewReader(client)
+}
+
+// do sends a command and reads the first n lines of its reply.
+func (s *SuitePubSub) do(c net.Conn, r *bufio.Reader, n int, args ...string) string {
+	cmd := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, a := range args {
+		cmd += "$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n"
+	}
+
+	go c.Write([]byte(cmd))
+
+	return s.read(r, n)
+}
+
+func (s *SuitePubSub) read(r *bufio.Reader, n int) string {
+	reply := ""
+	for i := 0; i < n; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			s.FailNow("error reading reply", err)
+		}
+		reply += line
+	}
+
+	return reply
+}
+
+func (s *SuitePubSub) TestFanOut() {
+	c1, r1 := s.connect()
+	defer c1.Close()
+	c2, r2 := s.connect()
+	defer c2.Close()
+
+	s.Equal("*3\r\n$9\r\nsubscribe\r\n$3\r\nch0\r\n:1\r\n", s.do(c1, r1, 6, "subscribe", "ch0"))
+	s.Equal("*3\r\n$10\r\npsubscribe\r\n$3\r\nch*\r\n:1\r\n", s.do(c2, r2, 6, "psubscribe", "ch*"))
+	s.Equal("*3\r\n$9\r\nsubscribe\r\n$3\r\nch0\r\n:2\r\n", s.do(c2, r2, 6, "subscribe", "ch0"))
+	s.Equal(1, s.upstream.count("ch0"), "channels should be subscribed upstream once")
+
+	s.Equal("-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n",
+		s.do(c1, r1, 1, "get", "k00"))
+
+	s.upstream.ch <- &redis.Message{Channel: "ch0", Payload: "hi"}
+	s.upstream.ch <- &redis.Message{Channel: "ch0", Pattern: "ch*", Payload: "hi"}
+
+	s.Equal("*3\r\n$7\r\nmessage\r\n$3\r\nch0\r\n$2\r\nhi\r\n", s.read(r1, 7), "message should reach the subscriber")
+	r := s.read(r2, 7)
+	r += s.read(r2, 9)
+	s.Contains(r, "*3\r\n$7\r\nmessage\r\n$3\r\nch0\r\n$2\r\nhi\r\n", "message should reach every subscriber")
+	s.Contains(r, "*4\r\n$8\r\npmessage\r\n$3\r\nch*\r\n$3\r\nch0\r\n$2\r\nhi\r\n", "pattern subscribers should get pmessage")
+
+	s.Equal("*3\r\n$11\r\nunsubscribe\r\n$3\r\nch0\r\n:0\r\n", s.do(c1, r1, 6, "unsubscribe"))
+	s.Equal(1, s.upstream.count("ch0"), "channels should stay subscribed while clients listen")
+
+	c2.Close()
+	<-time.After(time.Millisecond * 5)
+	s.Equal(0, s.upstream.count("ch0"), "channels should be unsubscribed once no client listens")
+	s.Equal(0, s.upstream.count("ch*"), "patterns of disconnected clients should be released")
+}
+
+func (s *SuitePubSub) TestSlowClient() {
+	c, r := s.connect()
+	defer c.Close()
+
+	s.do(c, r, 6, "subscribe", "ch0")
+
+	// the client doesn't read, so the buffer of 2 messages fills up
+	for i := 0; i < 4; i++ {
+		s.upstream.ch <- &redis.Message{Channel: "ch0", Payload: "hi"}
+	}
+
+	<-time.After(time.Millisecond * 5)
+	s.Equal(0, s.upstream.count("ch0"), "slow clients should be disconnected")
+}
+
+func TestPubSubSuite(t *testing.T) {
+	suite.Run(t, new(SuitePubSub))
+}
@@ -2,82 +2,989 @@ package proxy
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
-
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxMultiBulkLen = 1024 * 1024
+	maxBulkLen      = 512 * 1024 * 1024
+	maxInlineLen    = 64 * 1024
+
+	// like redis, clients not authenticated yet can only send a few small
+	// args, so they can't make the proxy allocate large buffers
+	maxUnauthMultiBulkLen = 10
+	maxUnauthBulkLen      = 16 * 1024
+	maxUnauthInlineLen    = 16 * 1024
+
+	// bulkChunk is the size over which bulk strings are read as they
+	// arrive, rather than allocated at once from their announced length.
+	bulkChunk = 64 * 1024
+
+	// handshakeTimeout bounds the TLS handshake of the redis clients.
+	handshakeTimeout = time.Second * 10
+
+	// defaultDatabases is the number of databases of a redis server with
+	// the default configuration.
+	defaultDatabases = 16
+
+	acceptRetryDelay = time.Millisecond * 5
 )
 
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
 type redisServer struct {
-	Addr    string
-	Handler func(string) (string, error)
+	Addr string
+	// Handler runs GET, returning redis.Nil for missing keys.
+	Handler   func(db int, key string) (string, error)
+	TLSConfig *tls.Config
+
+	// Exec runs the commands that are proxied to redis, other than GET.
+	Exec func(db int, args []string) (interface{}, error)
+
+	// DB is the database clients start on.
+	DB int
+	// Databases is the number of databases clients can SELECT, 0 uses
+	// defaultDatabases.
+	Databases int
+
+	// Users, when set, requires clients to AUTH before running commands.
+	Users *users
+
+	// Info returns the sections of the INFO reply.
+	Info func() []infoSection
+
+	// PubSub, when set, serves SUBSCRIBE and PSUBSCRIBE.
+	PubSub *hub
+
+	// Tx opens the dedicated upstream connection of a transaction on db.
+	Tx func(db int) (txConn, error)
+
+	// Invalidate drops from the cache what a write command that bypassed
+	// the workers touched.
+	Invalidate func(db int, args []string)
+
+	mu      sync.Mutex
+	clients map[int64]*redisConn
+	nextID  int64
+
+	// connections and commands are counters reported by INFO, accessed
+	// atomically.
+	connections int64
+	commands    int64
+}
+
+// redisConn is a client connected to the redis server.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	id      int64
+	created time.Time
+	// db is the database selected by the client.
+	db int
+	// quit closes the connection once the reply is sent.
+	quit bool
+
+	// wmu guards w once the client subscribes, as messages are written
+	// by the subscriber's goroutine.
+	wmu sync.Mutex
+	sub *subscriber
+	// subs is the number of channels and patterns the client is
+	// subscribed to, it's in subscribe mode while it's not zero.
+	subs int64
+
+	// tx is set while the client is pinned to an upstream connection by
+	// WATCH or MULTI.
+	tx      txConn
+	multi   bool
+	aborted bool
+	// queued are the commands queued since MULTI.
+	queued [][]string
+
+	// mu guards the fields read by other connections for CLIENT LIST.
+	mu     sync.Mutex
+	user   *user
+	name   string
+	cmd    string
+	active time.Time
+}
+
+func newRedisConn(conn net.Conn) *redisConn {
+	now := time.Now()
+
+	return &redisConn{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		created: now,
+		active:  now,
+	}
+}
+
+func (c *redisConn) writeStatus(s string) {
+	fmt.Fprintf(c.w, "+%s\r\n", s)
+}
+
+func (c *redisConn) writeError(s string) {
+	fmt.Fprintf(c.w, "-%s\r\n", s)
+}
+
+// reject writes the error of a command refused by the proxy, aborting the
+// transaction the client is in, if any, like redis does.
+func (c *redisConn) reject(s string) {
+	if c.multi {
+		c.aborted = true
+	}
+
+	c.writeError(s)
 }
 
-func readLen(r *bufio.Reader) (int, error) {
+func (c *redisConn) writeInt(n int64) {
+	fmt.Fprintf(c.w, ":%d\r\n", n)
+}
+
+func (c *redisConn) writeBulk(s string) {
+	fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func (c *redisConn) writeNil() {
+	c.w.WriteString("$-1\r\n")
+}
+
+// writeNilArray writes the null array replied by an EXEC that didn't run.
+func (c *redisConn) writeNilArray() {
+	c.w.WriteString("*-1\r\n")
+}
+
+func (c *redisConn) writeArrayLen(n int) {
+	fmt.Fprintf(c.w, "*%d\r\n", n)
+}
+
+// writeReply encodes a value as returned by go-redis.
+func (c *redisConn) writeReply(v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		c.writeNil()
+	case statusReply:
+		c.writeStatus(string(v))
+	case string:
+		c.writeBulk(v)
+	case int64:
+		c.writeInt(v)
+	case []string:
+		c.writeArrayLen(len(v))
+		for _, s := range v {
+			c.writeBulk(s)
+		}
+	case []interface{}:
+		c.writeArrayLen(len(v))
+		for _, e := range v {
+			c.writeReply(e)
+		}
+	case error:
+		c.writeError(v.Error())
+	default:
+		c.writeBulk(fmt.Sprint(v))
+	}
+}
+
+// readLine reads a line terminated by \r\n, without the terminator.
+func readLine(r *bufio.Reader) (string, error) {
+	s, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	if len(s) < 2 || s[len(s)-2] != '\r' {
+		return "", protocolError("expected '\\r\\n'")
+	}
+
+	return s[:len(s)-2], nil
+}
+
+func readInt(r *bufio.Reader) (int, error) {
+	s, err := readLine(r)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, protocolError("invalid length")
+	}
+
+	return n, nil
+}
+
+// readLen reads the header of a multibulk request of up to max args.
+func readLen(r *bufio.Reader, max int) (int, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
 	// check if first byte is not *
-	b, _ := r.ReadByte()
-	if b != 0x2a {
-		return 0, nil
+	if b != '*' {
+		return 0, protocolError(fmt.Sprintf("expected '*', got '%c'", b))
+	}
+
+	n, err := readInt(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if n > max {
+		return 0, protocolError("invalid multibulk length")
 	}
 
-	// we read until we get a \n
-	s, _ := r.ReadString('\n')
-	i := strings.Index(s, "\r")
-	n, _ := strconv.Atoi(s[:i])
 	return n, nil
 }
 
-func readVal(r *bufio.Reader) (string, error) {
+// readVal reads a bulk string of up to max bytes of a multibulk request.
+// Large strings are read as they arrive, so a client announcing a length it
+// doesn't send can't make the proxy allocate it.
+func readVal(r *bufio.Reader, max int) (string, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
 	// check if first byte is not $
-	b, _ := r.ReadByte()
-	if b != 0x24 {
-		return "", nil
+	if b != '$' {
+		return "", protocolError(fmt.Sprintf("expected '$', got '%c'", b))
+	}
+
+	n, err := readInt(r)
+	if err != nil {
+		return "", err
+	}
+
+	if n < 0 || n > max {
+		return "", protocolError("invalid bulk length")
+	}
+
+	var buf bytes.Buffer
+	if n <= bulkChunk {
+		buf.Grow(n)
 	}
 
-	// read the len
-	s, _ := r.ReadString('\n')
-	i := strings.Index(s, "\r")
+	if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+
+	var crlf [2]byte
+	if _, err := io.ReadFull(r, crlf[:]); err != nil {
+		return "", err
+	}
 
-	// read the val
-	s, _ = r.ReadString('\n')
-	i = strings.Index(s, "\r")
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		return "", protocolError("expected '\\r\\n'")
+	}
 
-	return strings.ToLower(s[:i]), nil
+	return buf.String(), nil
 }
 
-func (r *redisServer) handle(conn net.Conn) {
-	reader := bufio.NewReader(conn)
-	l, _ := readLen(reader)
+// readInline reads a command sent as a line of space separated args, as
+// typed in telnet.
+func readInline(r *bufio.Reader, maxLen int) ([]string, error) {
+	var line []byte
+	for {
+		b, err := r.ReadSlice('\n')
+		if len(line)+len(b) > maxLen {
+			return nil, protocolError("too big inline request")
+		}
+		line = append(line, b...)
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	return splitArgs(strings.TrimRight(string(line), "\r\n"))
+}
+
+// splitArgs splits an inline command like redis does, args can be quoted
+// with double quotes, supporting escapes like \n or \x00, or with single
+// quotes.
+func splitArgs(line string) ([]string, error) {
+	args := []string{}
+	for i := 0; ; {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		var quote byte
+		if line[i] == '"' || line[i] == '\'' {
+			quote = line[i]
+			i++
+		}
+
+		for {
+			if i == len(line) {
+				if quote != 0 {
+					return nil, protocolError("unbalanced quotes in request")
+				}
+				break
+			}
+
+			c := line[i]
+			if quote == 0 {
+				if isSpace(c) {
+					break
+				}
+				arg = append(arg, c)
+				i++
+				continue
+			}
+
+			if c == quote {
+				// the closing quote must be followed by a space
+				if i+1 < len(line) && !isSpace(line[i+1]) {
+					return nil, protocolError("unbalanced quotes in request")
+				}
+				i++
+				break
+			}
+
+			if c == '\\' && i+1 < len(line) {
+				if quote == '\'' {
+					if line[i+1] == '\'' {
+						c = '\''
+						i++
+					}
+				} else if line[i+1] == 'x' && i+3 < len(line) && isHex(line[i+2]) && isHex(line[i+3]) {
+					n, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					c = byte(n)
+					i += 3
+				} else {
+					i++
+					switch line[i] {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					default:
+						c = line[i]
+					}
+				}
+			}
+
+			arg = append(arg, c)
+			i++
+		}
 
-	args := make([]string, l)
+		args = append(args, string(arg))
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// readCommand reads the next command sent by the client, either as a
+// multibulk or inline. The command name is lowercased. Clients not yet
+// authenticated are limited to smaller requests, inline or multibulk.
+func readCommand(r *bufio.Reader, authenticated bool) ([]string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if b[0] != '*' {
+		maxLen := maxInlineLen
+		if !authenticated {
+			maxLen = maxUnauthInlineLen
+		}
+
+		args, err := readInline(r, maxLen)
+		if err != nil {
+			return nil, err
+		}
+
+		if !authenticated && len(args) > maxUnauthMultiBulkLen {
+			return nil, protocolError("too many args in inline request")
+		}
+
+		if len(args) > 0 {
+			args[0] = strings.ToLower(args[0])
+		}
+
+		return args, nil
+	}
+
+	maxLen, maxBulk := maxMultiBulkLen, maxBulkLen
+	if !authenticated {
+		maxLen, maxBulk = maxUnauthMultiBulkLen, maxUnauthBulkLen
+	}
+
+	l, err := readLen(r, maxLen)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0, l)
 	for i := 0; i < l; i++ {
-		v, _ := readVal(reader)
-		args[i] = v
+		v, err := readVal(r, maxBulk)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, v)
 	}
 
-	var res string
+	if len(args) > 0 {
+		args[0] = strings.ToLower(args[0])
+	}
+
+	return args, nil
+}
+
+func (r *redisServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	c := newRedisConn(conn)
+	c.db = r.DB
+	if tc, ok := conn.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(handshakeTimeout))
+		err := tc.Handshake()
+		tc.SetDeadline(time.Time{})
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"addr":  conn.RemoteAddr(),
+				"error": err,
+			}).Debug("tls handshake failed")
+			return
+		}
 
+		if r.Users != nil {
+			state := tc.ConnectionState()
+			c.user = r.Users.fromCertificate(&state)
+		}
+	}
+
+	r.register(c)
+	defer r.unregister(c)
+
+	defer func() {
+		if c.sub != nil {
+			r.PubSub.remove(c.sub)
+		}
+
+		r.release(c)
+	}()
+
+	for {
+		args, err := readCommand(c.r, r.Users == nil || c.user != nil)
+		if err != nil {
+			if perr, ok := err.(protocolError); ok {
+				c.wmu.Lock()
+				c.writeError("ERR " + perr.Error())
+				c.w.Flush()
+				c.wmu.Unlock()
+			}
+
+			if err != io.EOF {
+				log.WithFields(log.Fields{
+					"addr":  conn.RemoteAddr(),
+					"error": err,
+				}).Debug("closing redis client connection")
+			}
+			return
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		c.touch(args[0])
+		atomic.AddInt64(&r.commands, 1)
+
+		c.wmu.Lock()
+		r.exec(c, args)
+		err = c.w.Flush()
+		c.wmu.Unlock()
+
+		if err != nil || c.quit {
+			return
+		}
+	}
+}
+
+func (r *redisServer) exec(c *redisConn, args []string) {
 	cmd := args[0]
+
+	spec, ok := commandTable[cmd]
+	if !ok {
+		if r.Users != nil && c.user == nil {
+			c.reject("NOAUTH Authentication required.")
+			return
+		}
+
+		c.reject(fmt.Sprintf("ERR unknown command '%s'", cmd))
+		return
+	}
+
+	if !spec.validArity(len(args)) {
+		c.reject(fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd))
+		return
+	}
+
 	switch cmd {
+	case "auth":
+		r.auth(c, args)
+		return
+	case "hello":
+		r.hello(c, args)
+		return
+	case "quit":
+		c.quit = true
+		c.writeStatus("OK")
+		return
+	}
+
+	if !r.allowed(c, args) {
+		return
+	}
+
+	if txCommands[cmd] {
+		r.transaction(c, args)
+		return
+	}
+
+	if c.multi {
+		if cmd == "select" {
+			c.reject("ERR SELECT inside MULTI is not supported by the proxy")
+			return
+		}
+
+		r.forward(c, args)
+		return
+	}
+
+	if c.subs > 0 && !subscribeCommands[cmd] {
+		c.reject(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", cmd))
+		return
+	}
+
+	switch cmd {
+	case "ping":
+		if len(args) > 2 {
+			c.writeError("ERR wrong number of arguments for 'ping' command")
+			return
+		}
+
+		if c.subs > 0 {
+			c.writeArrayLen(2)
+			c.writeBulk("pong")
+			if len(args) == 2 {
+				c.writeBulk(args[1])
+			} else {
+				c.writeBulk("")
+			}
+			return
+		}
+
+		if len(args) == 2 {
+			c.writeBulk(args[1])
+			return
+		}
+
+		c.writeStatus("PONG")
+	case "echo":
+		c.writeBulk(args[1])
+	case "info":
+		r.info(c, args)
+	case "command":
+		r.command(c, args)
+	case "client":
+		r.client(c, args)
+	case "select":
+		r.selectDB(c, args)
+	case "subscribe", "psubscribe":
+		r.subscribe(c, args)
+	case "unsubscribe", "punsubscribe":
+		r.unsubscribe(c, args)
+	default:
+		if c.tx != nil {
+			r.forward(c, args)
+			return
+		}
+
+		r.proxy(c, args)
+	}
+}
+
+// proxy runs a command through the workers.
+func (r *redisServer) proxy(c *redisConn, args []string) {
+	switch args[0] {
 	case "get":
-		if l > 2 {
-			res = fmt.Sprintf("-err wrong number of arguments for '%s' command\r\n", cmd)
-			break
+		s, err := r.Handler(c.db, args[1])
+		if err == redis.Nil {
+			c.writeNil()
+			return
 		}
 
-		s, err := r.Handler(args[1])
 		if err != nil {
-			res = "$-1\r\n"
-			break
+			c.writeError(upstreamError(err))
+			return
 		}
 
-		res = fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+		c.writeBulk(s)
 	default:
-		res = fmt.Sprintf("-err unknown command '%s'\r\n", cmd)
+		v, err := r.Exec(c.db, args)
+		if err != nil {
+			c.writeError(upstreamError(err))
+			return
+		}
+
+		c.writeReply(commandReply(args, v))
+	}
+}
+
+// upstreamError formats an error returned while proxying a command. Errors
+// sent by redis are forwarded as they are.
+func upstreamError(err error) string {
+	if _, ok := err.(net.Error); ok {
+		return "ERR upstream unavailable: " + err.Error()
+	}
+
+	msg := err.Error()
+	if i := strings.IndexByte(msg, ' '); i > 0 && strings.ToUpper(msg[:i]) == msg[:i] {
+		return msg
+	}
+
+	return "ERR " + msg
+}
+
+// allowed checks the client is authenticated and allowed to run the
+// command, writing the error otherwise.
+func (r *redisServer) allowed(c *redisConn, args []string) bool {
+	if r.Users == nil {
+		return true
+	}
+
+	if c.user == nil {
+		c.reject("NOAUTH Authentication required.")
+		return false
+	}
+
+	if !c.user.can(args[0]) {
+		c.reject(fmt.Sprintf("NOPERM this user has no permissions to run the '%s' command", args[0]))
+		return false
+	}
+
+	if !c.user.can(args[0], commandKeys(args)...) {
+		c.reject("NOPERM this user has no permissions to access one of the keys used as arguments")
+		return false
+	}
+
+	return true
+}
+
+// login authenticates the client, writing the error if it fails.
+func (r *redisServer) login(c *redisConn, name string, password string) bool {
+	if r.Users == nil {
+		c.writeError("ERR AUTH called without any password configured for the default user. Are you sure your configuration is correct?")
+		return false
+	}
+
+	usr := r.Users.authenticate(name, password)
+	if usr == nil {
+		log.WithFields(log.Fields{
+			"addr": c.conn.RemoteAddr(),
+			"user": name,
+		}).Warn("failed authentication attempt")
+
+		c.writeError("WRONGPASS invalid username-password pair or user is disabled.")
+		return false
 	}
 
-	conn.Write([]byte(res))
+	c.mu.Lock()
+	c.user = usr
+	c.mu.Unlock()
+
+	return true
+}
+
+// auth handles AUTH [username] password.
+func (r *redisServer) auth(c *redisConn, args []string) {
+	if len(args) > 3 {
+		c.writeError("ERR syntax error")
+		return
+	}
+
+	name, password := defaultUser, args[1]
+	if len(args) == 3 {
+		name, password = args[1], args[2]
+	}
+
+	if r.login(c, name, password) {
+		c.writeStatus("OK")
+	}
+}
+
+// hello handles HELLO [protover [AUTH username password] [SETNAME name]].
+// Only RESP2 is supported.
+func (r *redisServer) hello(c *redisConn, args []string) {
+	if len(args) > 1 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil {
+			c.writeError("ERR Protocol version is not an integer or out of range")
+			return
+		}
+
+		if v != 2 {
+			c.writeError("NOPROTO unsupported protocol version")
+			return
+		}
+	}
+
+	var name string
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "auth":
+			if i+2 >= len(args) {
+				c.writeError("ERR syntax error")
+				return
+			}
+
+			if !r.login(c, args[i+1], args[i+2]) {
+				return
+			}
+			i += 2
+		case "setname":
+			if i+1 >= len(args) {
+				c.writeError("ERR syntax error")
+				return
+			}
+
+			if !validClientName(args[i+1]) {
+				c.writeError(errClientName)
+				return
+			}
+			name = args[i+1]
+			i++
+		default:
+			c.writeError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i]))
+			return
+		}
+	}
+
+	if r.Users != nil && c.user == nil {
+		c.writeError("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		return
+	}
+
+	if name != "" {
+		c.setName(name)
+	}
+
+	c.writeArrayLen(14)
+	c.writeBulk("server")
+	c.writeBulk("redis")
+	c.writeBulk("version")
+	c.writeBulk("6.0.0")
+	c.writeBulk("proto")
+	c.writeInt(2)
+	c.writeBulk("id")
+	c.writeInt(c.id)
+	c.writeBulk("mode")
+	c.writeBulk("standalone")
+	c.writeBulk("role")
+	c.writeBulk("master")
+	c.writeBulk("modules")
+	c.writeArrayLen(0)
+}
+
+// selectDB handles SELECT. Once pinned by WATCH the transaction's
+// connection is switched too.
+func (r *redisServer) selectDB(c *redisConn, args []string) {
+	db, err := strconv.Atoi(args[1])
+	if err != nil {
+		c.writeError("ERR value is not an integer or out of range")
+		return
+	}
+
+	databases := r.Databases
+	if databases <= 0 {
+		databases = defaultDatabases
+	}
+
+	if db < 0 || db >= databases {
+		c.writeError("ERR DB index is out of range")
+		return
+	}
+
+	if c.tx != nil {
+		if _, err := c.tx.Do("select", args[1]); err != nil {
+			c.writeError(upstreamError(err))
+			return
+		}
+	}
+
+	c.mu.Lock()
+	c.db = db
+	c.mu.Unlock()
+
+	c.writeStatus("OK")
+}
+
+// subscribeCommands are the commands allowed in subscribe mode.
+var subscribeCommands = map[string]bool{
+	"subscribe":    true,
+	"psubscribe":   true,
+	"unsubscribe":  true,
+	"punsubscribe": true,
+	"ping":         true,
+	"quit":         true,
+}
+
+// subscribe handles SUBSCRIBE and PSUBSCRIBE, the client entering
+// subscribe mode.
+func (r *redisServer) subscribe(c *redisConn, args []string) {
+	if r.PubSub == nil {
+		c.writeError("ERR pub/sub is not available")
+		return
+	}
+
+	if c.sub == nil {
+		c.sub = newSubscriber(c, r.PubSub.buffer)
+		go c.sub.run()
+	}
+
+	counts, err := r.PubSub.subscribe(c.sub, args[0] == "psubscribe", args[1:]...)
+	for i, n := range counts {
+		c.writeArrayLen(3)
+		c.writeBulk(args[0])
+		c.writeBulk(args[i+1])
+		c.writeInt(n)
+		c.subs = n
+	}
+
+	if err != nil {
+		c.writeError(upstreamError(err))
+	}
+}
+
+// unsubscribe handles UNSUBSCRIBE and PUNSUBSCRIBE, the client leaving
+// subscribe mode once it has no subscriptions left.
+func (r *redisServer) unsubscribe(c *redisConn, args []string) {
+	var names []string
+	var counts []int64
+	if c.sub != nil {
+		names, counts = r.PubSub.unsubscribe(c.sub, args[0] == "punsubscribe", args[1:]...)
+	} else {
+		names = args[1:]
+		counts = make([]int64, len(names))
+	}
+
+	if len(names) == 0 {
+		c.writeArrayLen(3)
+		c.writeBulk(args[0])
+		c.writeNil()
+		c.writeInt(c.subs)
+		return
+	}
+
+	for i, name := range names {
+		c.writeArrayLen(3)
+		c.writeBulk(args[0])
+		c.writeBulk(name)
+		c.writeInt(counts[i])
+		c.subs = counts[i]
+	}
+}
+
+// command handles COMMAND, COMMAND COUNT, COMMAND INFO and COMMAND DOCS,
+// describing the commands known to the proxy.
+func (r *redisServer) command(c *redisConn, args []string) {
+	names := []string{}
+	if len(args) == 1 {
+		for name := range commandTable {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	} else {
+		switch strings.ToLower(args[1]) {
+		case "count":
+			c.writeInt(int64(len(commandTable)))
+			return
+		case "info":
+			for _, name := range args[2:] {
+				names = append(names, strings.ToLower(name))
+			}
+		case "docs":
+			c.writeArrayLen(0)
+			return
+		default:
+			c.writeError(fmt.Sprintf("ERR Unknown subcommand or wrong number of arguments for '%s'. Try COMMAND HELP.", args[1]))
+			return
+		}
+	}
+
+	c.writeArrayLen(len(names))
+	for _, name := range names {
+		spec, ok := commandTable[name]
+		if !ok {
+			c.writeNil()
+			continue
+		}
+
+		flags := spec.flagNames()
+
+		c.writeArrayLen(6)
+		c.writeBulk(name)
+		c.writeInt(int64(spec.arity))
+		c.writeArrayLen(len(flags))
+		for _, f := range flags {
+			c.writeStatus(f)
+		}
+		c.writeInt(int64(spec.firstKey))
+		c.writeInt(int64(spec.lastKey))
+		c.writeInt(int64(spec.step))
+	}
 }
 
 func (r *redisServer) ListenAndServe() error {
@@ -86,8 +993,31 @@ func (r *redisServer) ListenAndServe() error {
 		return err
 	}
 
+	if r.TLSConfig != nil {
+		ln = tls.NewListener(ln, r.TLSConfig)
+	}
+
+	return r.Serve(ln)
+}
+
+// Serve accepts connections on ln, handling each one in a new goroutine.
+func (r *redisServer) Serve(ln net.Listener) error {
+	defer ln.Close()
+
 	for {
-		conn, _ := ln.Accept()
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Error("error accepting redis connection")
+				time.Sleep(acceptRetryDelay)
+				continue
+			}
+
+			return err
+		}
+
 		go r.handle(conn)
 	}
 }
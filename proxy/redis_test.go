@@ -0,0 +1,460 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/suite"
+)
+
+// txConnMock is a transaction connection recording the commands it runs.
+type txConnMock struct {
+	cmds   [][]interface{}
+	closed bool
+	multi  bool
+	// watched makes EXEC fail as if a watched key changed.
+	watched bool
+	// err is returned by the commands that aren't transaction commands.
+	err error
+}
+
+func (m *txConnMock) Do(args ...interface{}) (interface{}, error) {
+	m.cmds = append(m.cmds, args)
+
+	if m.multi && !txCommands[args[0].(string)] {
+		return "QUEUED", nil
+	}
+
+	switch args[0] {
+	case "multi":
+		m.multi = true
+		return "OK", nil
+	case "exec":
+		m.multi = false
+		if m.watched {
+			return nil, nil
+		}
+		return []interface{}{"OK", "v01"}, nil
+	case "watch", "discard":
+		m.multi = false
+		return "OK", nil
+	case "get":
+		if m.err != nil {
+			return nil, m.err
+		}
+		return "tx", nil
+	}
+
+	return "OK", nil
+}
+
+func (m *txConnMock) Close() error {
+	m.closed = true
+	return nil
+}
+
+type SuiteRedisServer struct {
+	suite.Suite
+
+	rs *redisServer
+	c  net.Conn
+	r  *bufio.Reader
+}
+
+func (s *SuiteRedisServer) SetupTest() {
+	s.serve(nil)
+}
+
+// serve connects to a new server requiring AUTH from users, when set. Users
+// are set before the connection is handled, which reads them right away.
+func (s *SuiteRedisServer) serve(users *users) {
+	if s.c != nil {
+		s.c.Close()
+	}
+
+	s.rs = &redisServer{
+		Users: users,
+		Handler: func(db int, key string) (string, error) {
+			if key == "user:1" {
+				return "v0" + strconv.Itoa(db), nil
+			}
+			if key == "down" {
+				return "", &net.OpError{Op: "read", Err: errors.New("connection reset")}
+			}
+			return "", redis.Nil
+		},
+	}
+
+	s.rs.Exec = func(db int, args []string) (interface{}, error) {
+		vals := []interface{}{}
+		for _, k := range args[1:] {
+			if k == "user:1" {
+				vals = append(vals, "v00")
+				continue
+			}
+			vals = append(vals, nil)
+		}
+		return vals, nil
+	}
+
+	client, server := net.Pipe()
+	go s.rs.handle(server)
+
+	s.c = client
+	s.r = bufio.NewReader(client)
+}
+
+func (s *SuiteRedisServer) TearDownTest() {
+	s.c.Close()
+}
+
+// do sends a command and reads its reply with readReply.
+func (s *SuiteRedisServer) do(args ...string) string {
+	cmd := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, a := range args {
+		cmd += "$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n"
+	}
+
+	go s.c.Write([]byte(cmd))
+
+	return s.readReply()
+}
+
+// readReply reads a single line, or a single bulk string.
+func (s *SuiteRedisServer) readReply() string {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		s.FailNow("error reading reply", err)
+	}
+
+	if line[0] == '$' && line != "$-1\r\n" {
+		n, _ := strconv.Atoi(line[1 : len(line)-2])
+		v := make([]byte, n+2)
+		if _, err := io.ReadFull(s.r, v); err != nil {
+			s.FailNow("error reading reply", err)
+		}
+		line += string(v)
+	}
+
+	return line
+}
+
+func (s *SuiteRedisServer) TestGet() {
+	s.Equal("$3\r\nv00\r\n", s.do("GET", "user:1"), "should reply with the value")
+	s.Equal("$-1\r\n", s.do("get", "user:2"), "should reply nil for missing keys")
+	s.Equal("-ERR upstream unavailable: read: connection reset\r\n", s.do("get", "down"), "upstream errors aren't missing keys")
+	s.Equal("-ERR wrong number of arguments for 'get' command\r\n", s.do("get"))
+	s.Equal("-ERR unknown command 'foo'\r\n", s.do("foo"))
+}
+
+func (s *SuiteRedisServer) TestMGet() {
+	s.Equal("*2\r\n", s.do("mget", "user:1", "user:2"), "should reply with an array")
+	s.Equal("$3\r\nv00\r\n", s.readReply(), "first element should be the value")
+	s.Equal("$-1\r\n", s.readReply(), "missing keys should be nil")
+}
+
+func (s *SuiteRedisServer) TestStatusReply() {
+	s.rs.Exec = func(db int, args []string) (interface{}, error) {
+		switch args[0] {
+		case "set":
+			if len(args) > 3 {
+				return "v00", nil
+			}
+			return "OK", nil
+		case "type":
+			return "hash", nil
+		}
+		return "OK", nil
+	}
+
+	s.Equal("+OK\r\n", s.do("set", "user:1", "v01"), "SET should reply with a status")
+	s.Equal("$3\r\nv00\r\n", s.do("set", "user:1", "v01", "get"), "SET with GET should reply with the old value")
+	s.Equal("+OK\r\n", s.do("mset", "k1", "v1", "k2", "v2"))
+	s.Equal("+OK\r\n", s.do("flushdb"))
+	s.Equal("+hash\r\n", s.do("type", "user:1"), "TYPE should reply with a status")
+	s.Equal("$2\r\nOK\r\n", s.do("echo", "OK"), "bulk strings should be left as they are")
+}
+
+func (s *SuiteRedisServer) TestAuth() {
+	users, _ := newUsers([]*user{
+		{Name: "default", Password: "p4ss", Commands: []string{"*"}, Keys: []string{"*"}},
+		{Name: "app", Password: "4pp", Commands: []string{"get"}, Keys: []string{"session:*"}},
+	})
+	s.serve(users)
+
+	s.Equal("-NOAUTH Authentication required.\r\n", s.do("get", "user:1"))
+	s.Equal("-WRONGPASS invalid username-password pair or user is disabled.\r\n", s.do("auth", "wrong"))
+	s.Equal("+OK\r\n", s.do("auth", "p4ss"))
+	s.Equal("$3\r\nv00\r\n", s.do("get", "user:1"))
+
+	s.Equal("+OK\r\n", s.do("auth", "app", "4pp"))
+	s.Equal("-NOPERM this user has no permissions to access one of the keys used as arguments\r\n", s.do("get", "user:1"))
+}
+
+func (s *SuiteRedisServer) TestUnauthenticatedLimits() {
+	users, _ := newUsers([]*user{
+		{Name: "default", Password: "p4ss", Commands: []string{"*"}, Keys: []string{"*"}},
+	})
+	s.serve(users)
+
+	go s.c.Write([]byte("*2\r\n$3\r\nget\r\n$" + strconv.Itoa(maxUnauthBulkLen+1) + "\r\n"))
+	s.Equal("-ERR Protocol error: invalid bulk length\r\n", s.readReply(), "large bulks should be rejected before AUTH")
+
+	s.serve(users)
+	go s.c.Write([]byte("get " + strings.Repeat("k", maxUnauthInlineLen) + "\r\n"))
+	s.Equal("-ERR Protocol error: too big inline request\r\n", s.readReply(), "large inline requests should be rejected before AUTH")
+
+	s.serve(users)
+	go s.c.Write([]byte("mget" + strings.Repeat(" k", maxUnauthMultiBulkLen) + "\r\n"))
+	s.Equal("-ERR Protocol error: too many args in inline request\r\n", s.readReply(), "inline requests with many args should be rejected before AUTH")
+}
+
+func (s *SuiteRedisServer) TestAuthenticatedLimits() {
+	users, _ := newUsers([]*user{
+		{Name: "default", Password: "p4ss", Commands: []string{"*"}, Keys: []string{"*"}},
+	})
+	s.serve(users)
+
+	args := make([]string, maxUnauthMultiBulkLen+1)
+	for i := range args {
+		args[i] = "k"
+	}
+
+	s.Equal("-ERR Protocol error: invalid multibulk length\r\n", s.do(append([]string{"mget"}, args...)...), "many args should be rejected before AUTH")
+
+	s.c.Close()
+	client, server := net.Pipe()
+	go s.rs.handle(server)
+	s.c, s.r = client, bufio.NewReader(client)
+
+	s.Equal("+OK\r\n", s.do("auth", "p4ss"))
+	s.Equal("$-1\r\n", s.do("get", strings.Repeat("k", maxUnauthBulkLen+1)), "large bulks should be accepted after AUTH")
+}
+
+func (s *SuiteRedisServer) TestHello() {
+	s.Equal("-NOPROTO unsupported protocol version\r\n", s.do("hello", "3"))
+	s.Equal("*14\r\n", s.do("hello", "2", "setname", "app"))
+
+	reply := map[string]string{}
+	for i := 0; i < 7; i++ {
+		k := s.readReply()
+		v := s.readReply()
+		if v == "*0\r\n" {
+			continue
+		}
+		reply[k] = v
+	}
+
+	s.Equal(":1\r\n", reply["$2\r\nid\r\n"], "HELLO should reply with the id of the client")
+	s.Equal("$3\r\napp\r\n", s.do("client", "getname"), "SETNAME should name the client")
+	s.Contains(s.do("client", "list"), "id=1 addr=pipe laddr=pipe fd=-1 name=app", "should list the client by its name")
+
+	s.Equal("-ERR Client names cannot contain spaces, newlines or special characters.\r\n", s.do("hello", "2", "setname", "a b"))
+}
+
+func (s *SuiteRedisServer) TestLocalCommands() {
+	s.Equal("+PONG\r\n", s.do("PING"))
+	s.Equal("$2\r\nhi\r\n", s.do("ping", "hi"))
+	s.Equal("$2\r\nhi\r\n", s.do("echo", "hi"))
+
+	s.Equal("*1\r\n", s.do("command", "info", "get"), "should describe the command")
+	s.Equal("*6\r\n", s.readReply())
+	s.Equal("$3\r\nget\r\n", s.readReply())
+	s.Equal(":2\r\n", s.readReply(), "arity should match")
+	s.Equal("*1\r\n", s.readReply())
+	s.Equal("+readonly\r\n", s.readReply())
+	s.Equal(":1\r\n", s.readReply())
+	s.Equal(":1\r\n", s.readReply())
+	s.Equal(":1\r\n", s.readReply())
+
+	info := s.do("info", "proxy")
+	s.Contains(info, "# Proxy\r\nconnected_clients:1\r\n", "should count the client")
+	s.NotContains(info, "# Cache", "should only include the requested sections")
+
+	s.Equal("+OK\r\n", s.do("quit"))
+	_, err := s.r.ReadByte()
+	s.Error(err, "connection should be closed after QUIT")
+}
+
+func (s *SuiteRedisServer) TestClient() {
+	s.Equal("$-1\r\n", s.do("client", "getname"), "name should be nil until set")
+	s.Equal("-ERR Client names cannot contain spaces, newlines or special characters.\r\n", s.do("client", "setname", "a b"))
+	s.Equal("+OK\r\n", s.do("client", "setname", "worker"))
+	s.Equal("$6\r\nworker\r\n", s.do("client", "getname"))
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.rs.handle(server)
+
+	other := bufio.NewReader(client)
+	go client.Write([]byte("*1\r\n$4\r\nping\r\n"))
+	other.ReadString('\n')
+
+	list := s.do("client", "list")
+	s.Contains(list, "id=1 addr=pipe laddr=pipe fd=-1 name=worker", "should list the client")
+	s.Contains(list, "id=2 addr=pipe", "should list the other client")
+
+	s.Equal(":1\r\n", s.do("client", "kill", "id", "2"), "should kill the other client")
+	_, err := other.ReadByte()
+	s.Error(err, "killed client should be disconnected")
+
+	s.Equal(":0\r\n", s.do("client", "kill", "id", "1"), "should skip the caller by default")
+}
+
+func (s *SuiteRedisServer) TestInline() {
+	go s.c.Write([]byte("GET user:1\r\n"))
+	s.Equal("$3\r\nv00\r\n", s.readReply(), "inline commands should be parsed")
+
+	go s.c.Write([]byte("echo \"a b\\x21\"\n"))
+	s.Equal("$4\r\na b!\r\n", s.readReply(), "quoted args should be parsed")
+
+	go s.c.Write([]byte("echo \"a\r\n"))
+	s.Equal("-ERR Protocol error: unbalanced quotes in request\r\n", s.readReply())
+}
+
+func (s *SuiteRedisServer) TestInlineTooBig() {
+	go s.c.Write([]byte("get " + strings.Repeat("k", maxInlineLen) + "\r\n"))
+	s.Equal("-ERR Protocol error: too big inline request\r\n", s.readReply(), "oversized requests should be rejected")
+}
+
+func (s *SuiteRedisServer) TestSelect() {
+	s.Equal("-ERR DB index is out of range\r\n", s.do("select", "16"))
+	s.Equal("+OK\r\n", s.do("select", "3"))
+	s.Equal("$3\r\nv03\r\n", s.do("get", "user:1"), "commands should run on the selected database")
+	s.Contains(s.do("client", "info"), " db=3 ", "client should report its database")
+
+	s.rs.Databases = 32
+	s.Equal("+OK\r\n", s.do("select", "16"), "the number of databases should be configurable")
+	s.Equal("-ERR DB index is out of range\r\n", s.do("select", "32"))
+}
+
+func (s *SuiteRedisServer) TestTransaction() {
+	tx := &txConnMock{}
+	s.rs.Tx = func(db int) (txConn, error) { return tx, nil }
+
+	invalidated := []string{}
+	s.rs.Invalidate = func(db int, args []string) {
+		invalidated = append(invalidated, commandKeys(args)...)
+	}
+
+	s.Equal("-ERR EXEC without MULTI\r\n", s.do("exec"))
+	s.Equal("+OK\r\n", s.do("watch", "user:1"))
+	s.Equal("$2\r\ntx\r\n", s.do("get", "user:1"), "reads should bypass the cache once pinned")
+	s.Equal("+OK\r\n", s.do("multi"))
+	s.Equal("+QUEUED\r\n", s.do("set", "user:1", "v01"))
+	s.Equal("+QUEUED\r\n", s.do("get", "user:2"))
+	s.Equal("*2\r\n", s.do("exec"))
+	s.Equal("+OK\r\n", s.readReply(), "replies of EXEC should keep their type")
+	s.Equal("$3\r\nv01\r\n", s.readReply())
+
+	s.Equal([]string{"user:1"}, invalidated, "keys written by EXEC should be invalidated")
+	s.True(tx.closed, "connection should be released after EXEC")
+	s.Len(tx.cmds, 6, "every command should run on the pinned connection")
+	s.Equal("$3\r\nv00\r\n", s.do("get", "user:1"), "reads should go through the workers again")
+}
+
+func (s *SuiteRedisServer) TestTransactionAbort() {
+	tx := &txConnMock{}
+	s.rs.Tx = func(db int) (txConn, error) { return tx, nil }
+
+	s.Equal("+OK\r\n", s.do("multi"))
+	s.Equal("-ERR wrong number of arguments for 'get' command\r\n", s.do("get"))
+	s.Equal("-EXECABORT Transaction discarded because of previous errors.\r\n", s.do("exec"))
+	s.Equal([]interface{}{"discard"}, tx.cmds[len(tx.cmds)-1], "transaction should be discarded upstream")
+	s.True(tx.closed, "connection should be released")
+}
+
+func (s *SuiteRedisServer) TestTransactionWatched() {
+	tx := &txConnMock{watched: true}
+	s.rs.Tx = func(db int) (txConn, error) { return tx, nil }
+
+	invalidated := 0
+	s.rs.Invalidate = func(db int, args []string) { invalidated++ }
+
+	s.Equal("+OK\r\n", s.do("watch", "user:1"))
+	s.Equal("+OK\r\n", s.do("multi"))
+	s.Equal("+QUEUED\r\n", s.do("set", "user:1", "v01"))
+	s.Equal("*-1\r\n", s.do("exec"), "an EXEC that didn't run should reply a null array")
+	s.Zero(invalidated, "nothing should be invalidated if EXEC didn't run")
+	s.True(tx.closed, "connection should be released")
+}
+
+func (s *SuiteRedisServer) TestTransactionBroken() {
+	tx := &txConnMock{err: &net.OpError{Op: "read", Err: errors.New("connection reset")}}
+	s.rs.Tx = func(db int) (txConn, error) { return tx, nil }
+
+	s.Equal("+OK\r\n", s.do("watch", "user:1"))
+	s.Contains(s.do("get", "user:1"), "connection reset")
+	s.True(tx.closed, "broken connection should be released")
+	s.Equal("$3\r\nv00\r\n", s.do("get", "user:1"), "reads should go through the workers again")
+}
+
+func (s *SuiteRedisServer) TestTransactionLimit() {
+	s.rs.Tx = func(db int) (txConn, error) { return nil, errTooManyTx }
+
+	s.Equal("-ERR max number of open transactions reached\r\n", s.do("multi"))
+	s.Equal("-ERR EXEC without MULTI\r\n", s.do("exec"), "client shouldn't be in a transaction")
+	s.Equal("$3\r\nv00\r\n", s.do("get", "user:1"), "reads should go through the workers")
+}
+
+func TestTxPool(t *testing.T) {
+	p := newTxPool("127.0.0.1:0", UpstreamOptions{}, 1)
+
+	tx, err := p.open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.open(0); err != errTooManyTx {
+		t.Errorf("opening more transactions than the max should fail, got %v", err)
+	}
+
+	tx.Close()
+	tx, err = p.open(0)
+	if err != nil {
+		t.Errorf("closing a transaction should free its slot, got %v", err)
+	} else {
+		tx.Close()
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string
+		err  bool
+	}{
+		{"get k00", []string{"get", "k00"}, false},
+		{"  set  k00   v00 ", []string{"set", "k00", "v00"}, false},
+		{`set k00 "hello world"`, []string{"set", "k00", "hello world"}, false},
+		{`set k00 "a\"b\n\x41"`, []string{"set", "k00", "a\"b\nA"}, false},
+		{`set k00 'it\'s \n'`, []string{"set", "k00", `it's \n`}, false},
+		{`set k00 ""`, []string{"set", "k00", ""}, false},
+		{"", []string{}, false},
+		{`set k00 "abc`, nil, true},
+		{`set k00 "abc"def`, nil, true},
+	}
+
+	for _, tt := range tests {
+		args, err := splitArgs(tt.line)
+		if (err != nil) != tt.err {
+			t.Errorf("splitArgs(%q) error = %v", tt.line, err)
+			continue
+		}
+
+		if !tt.err && !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("splitArgs(%q) = %q, want %q", tt.line, args, tt.args)
+		}
+	}
+}
+
+func TestRedisServerSuite(t *testing.T) {
+	suite.Run(t, new(SuiteRedisServer))
+}
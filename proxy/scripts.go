@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxScriptBodies bounds the bodies remembered for EVALSHA, the least
+// recently used ones are forgotten first.
+const maxScriptBodies = 1024
+
+// scripts keeps the body of the Lua scripts seen by the proxy, so EVALSHA
+// can be retried with EVAL when redis doesn't know the script, e.g. after
+// a restart. Only the last maxScriptBodies scripts are remembered, EVALSHA
+// of the others is forwarded as is.
+type scripts struct {
+	mu     sync.Mutex
+	bodies map[string]*list.Element
+	// lru orders the scripts from the most recently used, its values are
+	// *scriptBody.
+	lru *list.List
+
+	// cacheable maps the SHA of read only scripts to the ttl of their
+	// cached results. It's never modified once created.
+	cacheable map[string]time.Duration
+}
+
+type scriptBody struct {
+	sha  string
+	body string
+}
+
+func newScripts(cacheable map[string]time.Duration) *scripts {
+	c := make(map[string]time.Duration, len(cacheable))
+	for sha, ttl := range cacheable {
+		c[strings.ToLower(sha)] = ttl
+	}
+
+	return &scripts{
+		bodies:    make(map[string]*list.Element),
+		lru:       list.New(),
+		cacheable: c,
+	}
+}
+
+// add records the body of a script, returning its SHA.
+func (s *scripts) add(body string) string {
+	sum := sha1.Sum([]byte(body))
+	sha := hex.EncodeToString(sum[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.bodies[sha]; ok {
+		s.lru.MoveToFront(el)
+		return sha
+	}
+
+	s.bodies[sha] = s.lru.PushFront(&scriptBody{sha, body})
+	if s.lru.Len() > maxScriptBodies {
+		el := s.lru.Back()
+		s.lru.Remove(el)
+		delete(s.bodies, el.Value.(*scriptBody).sha)
+	}
+
+	return sha
+}
+
+func (s *scripts) body(sha string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.bodies[sha]
+	if !ok {
+		return "", false
+	}
+
+	s.lru.MoveToFront(el)
+	return el.Value.(*scriptBody).body, true
+}
+
+// ttl returns for how long the results of the script are cached, and
+// whether they're cached at all.
+func (s *scripts) ttl(sha string) (time.Duration, bool) {
+	ttl, ok := s.cacheable[sha]
+	return ttl, ok
+}
+
+// scriptKeys returns the keys passed to EVAL or EVALSHA, following their
+// numkeys argument.
+func scriptKeys(args []string) []string {
+	if len(args) < 3 {
+		return nil
+	}
+
+	n, err := strconv.Atoi(args[2])
+	if err != nil || n < 0 || 3+n > len(args) {
+		return nil
+	}
+
+	return args[3 : 3+n]
+}
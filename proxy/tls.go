@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TLSOptions configures TLS on the HTTP and redis listeners.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+
+	// CAFile holds the CAs used to verify client certificates.
+	CAFile string
+
+	// AuthClients is one of "no", "optional" or "yes", and only applies
+	// when CAFile is set.
+	AuthClients string
+}
+
+func (o *TLSOptions) enabled() bool {
+	return o.CertFile != "" || o.KeyFile != ""
+}
+
+func (o *TLSOptions) clientAuth() (tls.ClientAuthType, error) {
+	if o.CAFile == "" {
+		return tls.NoClientCert, nil
+	}
+
+	switch o.AuthClients {
+	case "no":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "yes", "":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+
+	return tls.NoClientCert, fmt.Errorf("invalid tls client auth %q, must be no, optional or yes", o.AuthClients)
+}
+
+// certReloader serves the certificate and client CAs loaded from disk,
+// allowing them to be replaced without restarting the listeners.
+// Connections already established keep using the old ones.
+type certReloader struct {
+	opts TLSOptions
+	auth tls.ClientAuthType
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	cas  *x509.CertPool
+}
+
+func newCertReloader(opts TLSOptions) (*certReloader, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, errors.New("both the tls certificate and key must be set")
+	}
+
+	auth, err := opts.clientAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &certReloader{
+		opts: opts,
+		auth: auth,
+	}
+
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.opts.CertFile, c.opts.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading tls certificate: %v", err)
+	}
+
+	var cas *x509.CertPool
+	if c.opts.CAFile != "" {
+		cas, err = loadCertPool(c.opts.CAFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.cas = cas
+	c.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"cert": c.opts.CertFile,
+		"ca":   c.opts.CAFile,
+	}).Info("tls certificates loaded")
+
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cert, nil
+}
+
+// tlsConfig returns a config that picks up the latest certificates on
+// every handshake.
+func (c *certReloader) tlsConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.getCertificate,
+		ClientAuth:     c.auth,
+	}
+
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+
+		clone := cfg.Clone()
+		clone.GetConfigForClient = nil
+		clone.ClientCAs = c.cas
+
+		return clone, nil
+	}
+
+	return cfg
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error loading tls CA: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,300 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/suite"
+)
+
+// testCert is a certificate generated on the fly for the tests.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(cn string, parent *testCert) (*testCert, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &testCert{cert, key}, nil
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *testCert) keyPEM() []byte {
+	b, _ := x509.MarshalECPrivateKey(c.key)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	cert, _ := tls.X509KeyPair(c.certPEM(), c.keyPEM())
+	return cert
+}
+
+// write stores the certificate and key in dir as name.crt and name.key.
+func (c *testCert) write(dir string, name string) (string, string, error) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	if err := ioutil.WriteFile(certFile, c.certPEM(), 0600); err != nil {
+		return "", "", err
+	}
+
+	return certFile, keyFile, ioutil.WriteFile(keyFile, c.keyPEM(), 0600)
+}
+
+type SuiteTLS struct {
+	suite.Suite
+
+	dir    string
+	ca     *testCert
+	client *testCert
+	certs  *certReloader
+	ln     net.Listener
+}
+
+func (s *SuiteTLS) SetupSuite() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "rp-tls")
+	if err != nil {
+		s.FailNow("error creating temp dir", err)
+	}
+
+	s.ca, err = newTestCert("rp-ca", nil)
+	if err != nil {
+		s.FailNow("error generating CA", err)
+	}
+
+	server, err := newTestCert("localhost", s.ca)
+	if err != nil {
+		s.FailNow("error generating server certificate", err)
+	}
+
+	s.client, err = newTestCert("app", s.ca)
+	if err != nil {
+		s.FailNow("error generating client certificate", err)
+	}
+
+	caFile, _, err := s.ca.write(s.dir, "ca")
+	if err != nil {
+		s.FailNow("error writing CA", err)
+	}
+
+	certFile, keyFile, err := server.write(s.dir, "server")
+	if err != nil {
+		s.FailNow("error writing server certificate", err)
+	}
+
+	s.certs, err = newCertReloader(TLSOptions{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   caFile,
+	})
+	if err != nil {
+		s.FailNow("error loading certificates", err)
+	}
+
+	users, _ := newUsers([]*user{
+		{Name: "app", Commands: []string{"get"}, Keys: []string{"*"}},
+	})
+
+	rs := &redisServer{
+		Users: users,
+		Handler: func(db int, key string) (string, error) {
+			if key == "k00" {
+				return "v00", nil
+			}
+			return "", redis.Nil
+		},
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.FailNow("error listening", err)
+	}
+
+	s.ln = tls.NewListener(ln, s.certs.tlsConfig())
+	go rs.Serve(s.ln)
+}
+
+func (s *SuiteTLS) TearDownSuite() {
+	s.ln.Close()
+	os.RemoveAll(s.dir)
+}
+
+func (s *SuiteTLS) dial(certs ...tls.Certificate) (*tls.Conn, error) {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.ca.cert)
+
+	return tls.Dial("tcp", s.ln.Addr().String(), &tls.Config{
+		RootCAs:      pool,
+		Certificates: certs,
+	})
+}
+
+func (s *SuiteTLS) get(conn *tls.Conn, key string) string {
+	conn.Write([]byte("*2\r\n$3\r\nget\r\n$" + strconv.Itoa(len(key)) + "\r\n" + key + "\r\n"))
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err.Error()
+	}
+
+	if line[0] == '$' && line != "$-1\r\n" {
+		v, _ := r.ReadString('\n')
+		line += v
+	}
+
+	return line
+}
+
+func (s *SuiteTLS) TestClientCertificateUser() {
+	conn, err := s.dial(s.client.tlsCertificate())
+	if err != nil {
+		s.FailNow("error connecting", err)
+	}
+	defer conn.Close()
+
+	s.Equal("$3\r\nv00\r\n", s.get(conn, "k00"), "client certificate should authenticate the user")
+}
+
+func (s *SuiteTLS) TestMissingClientCertificate() {
+	conn, err := s.dial()
+	if err == nil {
+		s.NotEqual("$3\r\nv00\r\n", s.get(conn, "k00"), "clients without certificate should be rejected")
+		conn.Close()
+	}
+}
+
+func (s *SuiteTLS) TestReload() {
+	old, err := s.dial(s.client.tlsCertificate())
+	if err != nil {
+		s.FailNow("error connecting", err)
+	}
+	defer old.Close()
+
+	server, err := newTestCert("localhost", s.ca)
+	if err != nil {
+		s.FailNow("error generating server certificate", err)
+	}
+
+	if _, _, err := server.write(s.dir, "server"); err != nil {
+		s.FailNow("error writing server certificate", err)
+	}
+
+	if err := s.certs.reload(); err != nil {
+		s.FailNow("error reloading certificates", err)
+	}
+
+	conn, err := s.dial(s.client.tlsCertificate())
+	if err != nil {
+		s.FailNow("error connecting", err)
+	}
+	defer conn.Close()
+
+	serial := conn.ConnectionState().PeerCertificates[0].SerialNumber
+	s.Equal(0, serial.Cmp(server.cert.SerialNumber), "new connections should use the reloaded certificate")
+	s.Equal("$3\r\nv00\r\n", s.get(old, "k00"), "existing connections should keep working")
+}
+
+func (s *SuiteTLS) TestUpstreamTLS() {
+	caFile, _, err := s.ca.write(s.dir, "ca")
+	if err != nil {
+		s.FailNow("error writing CA", err)
+	}
+
+	certFile, keyFile, err := s.client.write(s.dir, "client")
+	if err != nil {
+		s.FailNow("error writing client certificate", err)
+	}
+
+	opts := UpstreamOptions{
+		TLSCAFile:   caFile,
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+	}
+
+	addr := s.ln.Addr().String()
+	if err := opts.loadTLS(addr); err != nil {
+		s.FailNow("error loading upstream tls", err)
+	}
+	s.Equal("127.0.0.1", opts.tlsConfig.ServerName, "server name should default to the redis host")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	workers := make(chan chan Job)
+	w, err := newWorker(addr, opts, newCache(cacheCap, defaultExp, maxWorkers), newScripts(nil), workers)
+	if err != nil {
+		s.FailNow("error starting worker", err)
+	}
+	go w.run(ctx)
+
+	job := newJob(ctx, "k00")
+	<-workers <- job
+
+	r := <-job.res
+	s.Equal(http.StatusOK, r.code, "should be 200")
+	s.Equal("v00", r.body, "value should be fetched over TLS")
+}
+
+func TestTLSSuite(t *testing.T) {
+	suite.Run(t, new(SuiteTLS))
+}
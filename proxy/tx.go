@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultMaxTransactions is the number of transactions open at once when
+// Options.MaxTransactions isn't set.
+const defaultMaxTransactions = 64
+
+var errTooManyTx = errors.New("ERR max number of open transactions reached")
+
+// txConn is a dedicated upstream connection a client is pinned to from
+// WATCH or MULTI until the transaction finishes.
+type txConn interface {
+	Do(args ...interface{}) (interface{}, error)
+	Close() error
+}
+
+type txReq struct {
+	args []interface{}
+	res  chan txRes
+}
+
+type txRes struct {
+	val interface{}
+	err error
+}
+
+// redisTx runs commands on the sticky connection of a go-redis Tx, which
+// is only available within the callback of Watch, so it's kept open by a
+// goroutine until closed. The connection is switched back to the client's
+// database before returning to the pool.
+type redisTx struct {
+	reqs chan txReq
+	done chan struct{}
+	// release frees the slot of the transaction in its txPool.
+	release func()
+}
+
+// newRedisTx pins a connection of client, bound to the database def, and
+// selects db on it.
+func newRedisTx(client *redis.Client, db int, def int) *redisTx {
+	t := &redisTx{
+		reqs: make(chan txReq),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(t.done)
+
+		err := client.Watch(func(tx *redis.Tx) error {
+			cur := def
+			if db != def {
+				if err := tx.Select(db).Err(); err != nil {
+					for req := range t.reqs {
+						req.res <- txRes{nil, err}
+					}
+					return err
+				}
+				cur = db
+			}
+
+			for req := range t.reqs {
+				cmd := redis.NewCmd(req.args...)
+				tx.Process(cmd)
+
+				v, err := cmd.Result()
+				if err == redis.Nil {
+					v, err = nil, nil
+				}
+
+				if err == nil && req.args[0] == "select" {
+					cur, _ = strconv.Atoi(req.args[1].(string))
+				}
+
+				req.res <- txRes{v, err}
+			}
+
+			if cur != def {
+				return tx.Select(def).Err()
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Debug("error closing transaction connection")
+		}
+	}()
+
+	return t
+}
+
+func (t *redisTx) Do(args ...interface{}) (interface{}, error) {
+	res := make(chan txRes, 1)
+	t.reqs <- txReq{args, res}
+
+	r := <-res
+	return r.val, r.err
+}
+
+// Close unwatches the keys and returns the connection to the pool.
+func (t *redisTx) Close() error {
+	close(t.reqs)
+	<-t.done
+
+	if t.release != nil {
+		t.release()
+	}
+
+	return nil
+}
+
+// txPool opens transactions on a redis client of their own, so that idle
+// transactions can't take the connections the health check, subscriptions
+// and keyspace notifications need. Up to max transactions are open at once,
+// each holding one connection of the pool.
+type txPool struct {
+	client *redis.Client
+	def    int
+	slots  chan struct{}
+}
+
+func newTxPool(addr string, opts UpstreamOptions, max int) *txPool {
+	if max <= 0 {
+		max = defaultMaxTransactions
+	}
+
+	o := opts
+	o.PoolSize = max
+
+	return &txPool{
+		client: redis.NewClient(o.redisOptions(addr)),
+		def:    opts.DB,
+		slots:  make(chan struct{}, max),
+	}
+}
+
+// open pins a connection for a transaction on db, failing right away when
+// too many transactions are open.
+func (p *txPool) open(db int) (txConn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		return nil, errTooManyTx
+	}
+
+	t := newRedisTx(p.client, db, p.def)
+	t.release = func() { <-p.slots }
+
+	return t, nil
+}
+
+// txCommands control transactions, they're never queued.
+var txCommands = map[string]bool{
+	"watch":   true,
+	"unwatch": true,
+	"multi":   true,
+	"exec":    true,
+	"discard": true,
+}
+
+// transaction handles WATCH, UNWATCH, MULTI, EXEC and DISCARD, pinning the
+// client to a dedicated upstream connection until EXEC, DISCARD or UNWATCH.
+func (r *redisServer) transaction(c *redisConn, args []string) {
+	switch args[0] {
+	case "watch":
+		if c.multi {
+			c.writeError("ERR WATCH inside MULTI is not allowed")
+			return
+		}
+	case "multi":
+		if c.multi {
+			c.writeError("ERR MULTI calls can not be nested")
+			return
+		}
+	case "exec", "discard":
+		if !c.multi {
+			c.writeError(fmt.Sprintf("ERR %s without MULTI", strings.ToUpper(args[0])))
+			return
+		}
+	case "unwatch":
+		if c.tx == nil {
+			c.writeStatus("OK")
+			return
+		}
+	}
+
+	if c.tx == nil {
+		if r.Tx == nil {
+			c.writeError("ERR transactions are not available")
+			return
+		}
+
+		tx, err := r.Tx(c.db)
+		if err != nil {
+			c.writeError(upstreamError(err))
+			return
+		}
+		c.tx = tx
+	}
+
+	if args[0] == "exec" && c.aborted {
+		r.release(c)
+		c.writeError("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	v, err := c.tx.Do(stringArgs(args)...)
+	if err != nil {
+		// the transaction is over, or the connection is broken
+		if _, ok := err.(net.Error); ok || args[0] == "exec" || args[0] == "discard" {
+			c.multi = false
+			r.release(c)
+		}
+
+		c.writeError(upstreamError(err))
+		return
+	}
+
+	switch args[0] {
+	case "multi":
+		c.multi = true
+	case "exec":
+		queued := c.queued
+		c.multi = false
+		r.release(c)
+
+		// a nil reply means a watched key changed and nothing ran
+		if v == nil {
+			c.writeNilArray()
+			return
+		}
+
+		if r.Invalidate != nil {
+			for _, q := range queued {
+				if commandTable[q[0]].flags&(cmdWrite|cmdScript) != 0 {
+					r.Invalidate(c.db, q)
+				}
+			}
+		}
+
+		if vals, ok := v.([]interface{}); ok && len(vals) == len(queued) {
+			for i, e := range vals {
+				vals[i] = commandReply(queued[i], e)
+			}
+		}
+
+		c.writeReply(v)
+		return
+	case "discard", "unwatch":
+		c.multi = false
+		r.release(c)
+	}
+
+	c.writeReply(commandReply(args, v))
+}
+
+// forward runs a command on the client's transaction connection, bypassing
+// the cache. Commands sent after MULTI are queued by redis.
+func (r *redisServer) forward(c *redisConn, args []string) {
+	v, err := c.tx.Do(stringArgs(args)...)
+	if err != nil {
+		if _, ok := err.(net.Error); ok {
+			// the connection is broken, along with the transaction
+			r.release(c)
+		} else if c.multi {
+			c.aborted = true
+		}
+
+		c.writeError(upstreamError(err))
+		return
+	}
+
+	if c.multi {
+		// the replies are sent by EXEC, once the commands run
+		c.queued = append(c.queued, args)
+		if s, ok := v.(string); ok {
+			v = statusReply(s)
+		}
+
+		c.writeReply(v)
+		return
+	}
+
+	if spec := commandTable[args[0]]; spec.flags&(cmdWrite|cmdScript) != 0 && r.Invalidate != nil {
+		r.Invalidate(c.db, args)
+	}
+
+	c.writeReply(commandReply(args, v))
+}
+
+// release discards the pending transaction, if any, and unpins the client
+// from its upstream connection.
+func (r *redisServer) release(c *redisConn) {
+	if c.tx == nil {
+		return
+	}
+
+	if c.multi {
+		c.tx.Do("discard")
+	}
+
+	c.tx.Close()
+	c.tx = nil
+	c.multi = false
+	c.aborted = false
+	c.queued = nil
+}
+
+// stringArgs converts args to the arguments of a go-redis command.
+func stringArgs(args []string) []interface{} {
+	a := make([]interface{}, len(args))
+	for i, arg := range args {
+		a[i] = arg
+	}
+
+	return a
+}
@@ -0,0 +1,531 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWatchHeartbeat  = time.Second * 15
+	defaultWatchBuffer     = 1024
+	defaultWatchMaxClients = 1000
+	defaultWatchMaxKeys    = 100
+
+	// watchClientBuffer is the number of events queued for a watching
+	// client before it's disconnected for being too slow.
+	watchClientBuffer = 256
+)
+
+var errTooManyWatchers = errors.New("too many clients watching keys")
+
+// watchEvent is a change of a key: "set" along with its new value, "del"
+// once it's gone, or "flush" when the whole database is flushed. "reset"
+// tells a resuming client the events it missed are no longer buffered.
+type watchEvent struct {
+	id uint64
+	// epoch is the one of the hub that numbered the event.
+	epoch string
+	kind  string
+	key   string
+	// data is the JSON payload of the event.
+	data []byte
+}
+
+// eventID is the id of e sent to clients, its number prefixed with the
+// epoch of the hub.
+func (e *watchEvent) eventID() string {
+	return e.epoch + "-" + strconv.FormatUint(e.id, 10)
+}
+
+// watchClient is a connection watching keys, by name or pattern.
+type watchClient struct {
+	keys     map[string]struct{}
+	patterns []string
+	// user, when set, limits the events to the keys it can access.
+	user *user
+
+	out  chan *watchEvent
+	done chan struct{}
+	once sync.Once
+}
+
+func newWatchClient(keys []string, patterns []string, usr *user) *watchClient {
+	c := &watchClient{
+		keys:     make(map[string]struct{}, len(keys)),
+		patterns: patterns,
+		user:     usr,
+		out:      make(chan *watchEvent, watchClientBuffer),
+		done:     make(chan struct{}),
+	}
+
+	for _, k := range keys {
+		c.keys[k] = struct{}{}
+	}
+
+	return c
+}
+
+func (c *watchClient) matches(e *watchEvent) bool {
+	if e.kind == "flush" || e.kind == "reset" {
+		return true
+	}
+
+	if c.user != nil && !c.user.canAccess(e.key) {
+		return false
+	}
+
+	if _, ok := c.keys[e.key]; ok {
+		return true
+	}
+
+	for _, p := range c.patterns {
+		if globMatch(p, e.key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// send queues e without blocking, disconnecting the client if its buffer
+// is full.
+func (c *watchClient) send(e *watchEvent) {
+	select {
+	case c.out <- e:
+	default:
+		log.WithFields(log.Fields{
+			"buffer": cap(c.out),
+		}).Warn("watching client too slow, disconnecting it")
+		c.close()
+	}
+}
+
+func (c *watchClient) close() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+// watchHub turns the changes of keys into events for the clients watching
+// them. Changes come from the writes made through rp, or from keyspace
+// notifications when they're enabled, and the new value of a changed key
+// is fetched once for all of its watchers. The last events are buffered so
+// clients can resume after reconnecting.
+type watchHub struct {
+	db    int
+	fetch func(key string) (*response, error)
+
+	// changes holds the keys changed, "" meaning the database was flushed.
+	changes chan string
+
+	maxClients int
+	maxKeys    int
+	size       int
+
+	mu      sync.Mutex
+	clients map[*watchClient]struct{}
+	events  []*watchEvent
+	nextID  uint64
+	// epoch tells the ids of events apart from those sent before rp
+	// restarted, which are numbered from 1 again.
+	epoch string
+}
+
+func newWatchHub(db int, fetch func(string) (*response, error), size int, maxClients int, maxKeys int) *watchHub {
+	if size <= 0 {
+		size = defaultWatchBuffer
+	}
+
+	if maxClients <= 0 {
+		maxClients = defaultWatchMaxClients
+	}
+
+	if maxKeys <= 0 {
+		maxKeys = defaultWatchMaxKeys
+	}
+
+	return &watchHub{
+		db:         db,
+		fetch:      fetch,
+		changes:    make(chan string, size),
+		maxClients: maxClients,
+		maxKeys:    maxKeys,
+		size:       size,
+		clients:    make(map[*watchClient]struct{}),
+		nextID:     1,
+		epoch:      strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+}
+
+// changed queues the keys changed, given as cache keys, ignoring those of
+// other databases. It never blocks, changes are dropped if the hub can't
+// keep up.
+func (h *watchHub) changed(keys []string) {
+	prefix := dbKey(h.db, "")
+	for _, k := range keys {
+		if strings.HasPrefix(k, prefix) {
+			h.queue(k[len(prefix):])
+		}
+	}
+}
+
+// flushed queues the flush of db, or of all of them if it's negative.
+func (h *watchHub) flushed(db int) {
+	if db < 0 || db == h.db {
+		h.queue("")
+	}
+}
+
+func (h *watchHub) queue(key string) {
+	select {
+	case h.changes <- key:
+	default:
+		log.WithFields(log.Fields{
+			"key": key,
+		}).Warn("too many changes to watched keys, dropping one")
+	}
+}
+
+// watched reports whether any client watches key.
+func (h *watchHub) watched(key string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e := &watchEvent{key: key}
+	for c := range h.clients {
+		if c.matches(e) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// run turns changes into events until ctx is done, disconnecting every
+// client then.
+func (h *watchHub) run(ctx context.Context) {
+	defer h.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case key := <-h.changes:
+			if key == "" {
+				h.publish(&watchEvent{kind: "flush", data: []byte("{}")})
+				continue
+			}
+
+			if !h.watched(key) {
+				continue
+			}
+
+			if e := h.event(key); e != nil {
+				h.publish(e)
+			}
+		}
+	}
+}
+
+// event builds the event of a change of key from its current value.
+func (h *watchHub) event(key string) *watchEvent {
+	res, err := h.fetch(key)
+	if err == nil && res.err != nil && res.err != errWrongType && res.code != http.StatusNotFound {
+		err = res.err
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"key":   key,
+			"error": err,
+		}).Error("error fetching watched key")
+		return nil
+	}
+
+	v := map[string]interface{}{"key": key}
+	kind := "set"
+
+	switch {
+	case res.err == errWrongType:
+		// only the type of other values is sent, they can be read with
+		// GET /keys/{key}
+		v["type"] = res.meta.kind
+	case res.code == http.StatusNotFound:
+		kind = "del"
+	case utf8.ValidString(res.body):
+		v["type"] = "string"
+		v["value"] = res.body
+	default:
+		v["type"] = "string"
+		v["value"] = base64.StdEncoding.EncodeToString([]byte(res.body))
+		v["encoding"] = "base64"
+	}
+
+	data, _ := json.Marshal(v)
+	return &watchEvent{kind: kind, key: key, data: data}
+}
+
+// publish numbers e, buffers it and sends it to the clients watching it.
+func (h *watchHub) publish(e *watchEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e.id, e.epoch = h.nextID, h.epoch
+	h.nextID++
+
+	h.events = append(h.events, e)
+	if len(h.events) > h.size {
+		h.events = h.events[1:]
+	}
+
+	for c := range h.clients {
+		if c.matches(e) {
+			c.send(e)
+		}
+	}
+}
+
+// add starts sending events to c. When resuming after the event with the
+// id last, the buffered events c missed are sent first, or a reset event if
+// some of them are no longer buffered, they wouldn't fit in the queue of c,
+// or last wasn't sent by this hub.
+func (h *watchHub) add(c *watchClient, last string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.clients) >= h.maxClients {
+		return errTooManyWatchers
+	}
+
+	h.clients[c] = struct{}{}
+
+	if last == "" {
+		return nil
+	}
+
+	lastID, ok := h.parseID(last)
+	if ok && lastID+1 == h.nextID {
+		return nil
+	}
+
+	// last is from before rp restarted, or the events after it aren't
+	// buffered anymore
+	reset := !ok || lastID+1 > h.nextID || len(h.events) == 0 || h.events[0].id > lastID+1
+
+	var replay []*watchEvent
+	if !reset {
+		for _, e := range h.events {
+			if e.id > lastID && c.matches(e) {
+				replay = append(replay, e)
+			}
+		}
+
+		// more than the client can queue would disconnect it
+		reset = len(replay) > cap(c.out)
+	}
+
+	if reset {
+		c.send(&watchEvent{kind: "reset", data: []byte("{}")})
+		return nil
+	}
+
+	for _, e := range replay {
+		c.send(e)
+	}
+
+	return nil
+}
+
+// parseID returns the number of the event with the id s, which is false
+// if s wasn't sent by this hub.
+func (h *watchHub) parseID(s string) (uint64, bool) {
+	i := strings.LastIndexByte(s, '-')
+	if i < 0 || s[:i] != h.epoch {
+		return 0, false
+	}
+
+	n, err := strconv.ParseUint(s[i+1:], 10, 64)
+	return n, err == nil
+}
+
+func (h *watchHub) remove(c *watchClient) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+
+	c.close()
+}
+
+// Close disconnects every client.
+func (h *watchHub) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.clients {
+		c.close()
+	}
+
+	return nil
+}
+
+// keyspace invalidates the keys changed outside of rp, as told by the
+// keyspace notifications of every database, and queues the changes of the
+// watched database. Notifications have to be enabled in redis, e.g. with
+// "CONFIG SET notify-keyspace-events KA".
+func (h *watchHub) keyspace(ctx context.Context, client *redis.Client, c *cache) {
+	ps := client.PSubscribe("__keyspace@*__:*")
+	defer ps.Close()
+
+	ch := ps.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			db, key, ok := keyspaceKey(msg.Channel)
+			if !ok {
+				continue
+			}
+
+			c.invalidate(dbKey(db, key))
+			if db == h.db {
+				h.queue(key)
+			}
+		}
+	}
+}
+
+// keyspaceKey returns the database and key of a keyspace notification
+// channel, __keyspace@<db>__:<key>.
+func keyspaceKey(channel string) (int, string, bool) {
+	const prefix = "__keyspace@"
+	if !strings.HasPrefix(channel, prefix) {
+		return 0, "", false
+	}
+
+	rest := channel[len(prefix):]
+	i := strings.Index(rest, "__:")
+	if i < 0 {
+		return 0, "", false
+	}
+
+	db, err := strconv.Atoi(rest[:i])
+	if err != nil {
+		return 0, "", false
+	}
+
+	return db, rest[i+len("__:"):], true
+}
+
+// watchHandler serves GET /watch?key=k00&pattern=user:*, pushing an event
+// whenever one of the keys, or a key matching one of the patterns, changes.
+// Events are sent as Server-Sent Events, or as JSON messages when the
+// request is a WebSocket upgrade. Clients resume from the event after the
+// one in the Last-Event-ID header, or the last_event_id query parameter.
+func watchHandler(d *Dispatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := r.URL.Query()
+		keys, patterns := q["key"], q["pattern"]
+		if len(keys)+len(patterns) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if len(keys)+len(patterns) > d.watch.maxKeys {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if !authorize(d.users, w, r, "get", keys...) {
+			return
+		}
+
+		var usr *user
+		if d.users != nil {
+			usr = d.users.fromRequest(r)
+		}
+
+		last := r.Header.Get("Last-Event-ID")
+		if last == "" {
+			last = q.Get("last_event_id")
+		}
+
+		c := newWatchClient(keys, patterns, usr)
+		if err := d.watch.add(c, last); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer d.watch.remove(c)
+
+		if isWebSocket(r) {
+			serveWebSocket(w, r, c, d.watchHeartbeat)
+			return
+		}
+
+		serveSSE(w, r, c, d.watchHeartbeat)
+	})
+}
+
+// serveSSE writes the events of c as Server-Sent Events, with a comment
+// every heartbeat so idle connections aren't dropped by proxies.
+func serveSSE(w http.ResponseWriter, r *http.Request, c *watchClient, heartbeat time.Duration) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	t := time.NewTicker(heartbeat)
+	defer t.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c.done:
+			return
+		case <-t.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case e := <-c.out:
+			if e.id > 0 {
+				_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.eventID(), e.kind, e.data)
+			} else {
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.kind, e.data)
+			}
+		}
+
+		if err != nil {
+			return
+		}
+		f.Flush()
+	}
+}
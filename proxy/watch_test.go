@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHub(size int) *watchHub {
+	fetch := func(key string) (*response, error) {
+		if key == "gone" {
+			return &response{code: http.StatusNotFound}, nil
+		}
+		if key == "down" {
+			return errorResponse(&net.OpError{Op: "read", Err: errors.New("connection reset")}), nil
+		}
+		return &response{body: "v:" + key}, nil
+	}
+
+	return newWatchHub(0, fetch, size, 2, 10)
+}
+
+// eventID is the id of the nth event published by h.
+func eventID(h *watchHub, n uint64) string {
+	return (&watchEvent{id: n, epoch: h.epoch}).eventID()
+}
+
+func receive(t *testing.T, c *watchClient) *watchEvent {
+	select {
+	case e := <-c.out:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+		return nil
+	}
+}
+
+func TestWatchHub(t *testing.T) {
+	h := newTestHub(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.run(ctx)
+
+	c := newWatchClient([]string{"k00", "gone"}, []string{"user:*"}, nil)
+	if err := h.add(c, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	h.changed([]string{dbKey(0, "other"), dbKey(1, "k00"), dbKey(0, "k00")})
+	e := receive(t, c)
+	if e.id != 1 || e.kind != "set" || e.key != "k00" || !strings.Contains(string(e.data), `"value":"v:k00"`) {
+		t.Errorf("unexpected event %d %s %s %s", e.id, e.kind, e.key, e.data)
+	}
+
+	h.changed([]string{dbKey(0, "user:1"), dbKey(0, "gone")})
+	if e = receive(t, c); e.id != 2 || e.key != "user:1" {
+		t.Errorf("unexpected event %d %s", e.id, e.key)
+	}
+	if e = receive(t, c); e.id != 3 || e.kind != "del" {
+		t.Errorf("unexpected event %d %s", e.id, e.kind)
+	}
+
+	h.flushed(1)
+	h.flushed(-1)
+	if e = receive(t, c); e.id != 4 || e.kind != "flush" {
+		t.Errorf("unexpected event %d %s", e.id, e.kind)
+	}
+
+	// only the last 2 events are buffered
+	resumed := newWatchClient([]string{"gone"}, nil, nil)
+	if err := h.add(resumed, eventID(h, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if e = receive(t, resumed); e.id != 3 {
+		t.Errorf("resuming should replay event 3, got %d", e.id)
+	}
+	if e = receive(t, resumed); e.id != 4 {
+		t.Errorf("resuming should replay event 4, got %d", e.id)
+	}
+
+	h.remove(resumed)
+
+	late := newWatchClient([]string{"k00"}, nil, nil)
+	if err := h.add(late, eventID(h, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if e = receive(t, late); e.kind != "reset" {
+		t.Errorf("resuming from a dropped event should reset, got %s", e.kind)
+	}
+
+	if err := h.add(newWatchClient([]string{"k00"}, nil, nil), ""); err != errTooManyWatchers {
+		t.Errorf("adding a third client should fail, got %v", err)
+	}
+}
+
+func TestWatchFetchError(t *testing.T) {
+	h := newTestHub(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.run(ctx)
+
+	c := newWatchClient([]string{"down", "k00"}, nil, nil)
+	if err := h.add(c, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// a key that can't be fetched isn't reported as deleted
+	h.changed([]string{dbKey(0, "down"), dbKey(0, "k00")})
+	if e := receive(t, c); e.id != 1 || e.key != "k00" {
+		t.Errorf("unexpected event %d %s %s", e.id, e.kind, e.key)
+	}
+}
+
+func TestWatchHandler(t *testing.T) {
+	d := &Dispatcher{
+		watch:          newTestHub(10),
+		watchHeartbeat: time.Second,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.watch.run(ctx)
+
+	ts := httptest.NewServer(watchHandler(d))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("watching no key should be 400, got %d", res.StatusCode)
+	}
+
+	res, err = http.Get(ts.URL + "?key=k00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	waitWatchers(t, d.watch, 1)
+	d.watch.changed([]string{dbKey(0, "k00")})
+
+	r := bufio.NewReader(res.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+
+	if lines[0] != "id: "+eventID(d.watch, 1) || lines[1] != "event: set" || !strings.HasPrefix(lines[2], "data: {") {
+		t.Errorf("unexpected event %q", lines)
+	}
+
+	// the same events over a WebSocket
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("GET /?key=k00&last_event_id=" + eventID(d.watch, 0) + " HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+
+	wr := bufio.NewReader(conn)
+	wsRes, err := http.ReadResponse(wr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wsRes.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("websocket upgrade should be 101, got %d", wsRes.StatusCode)
+	}
+
+	if accept := wsRes.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("unexpected accept key %q", accept)
+	}
+
+	opcode, payload, err := readServerFrame(wr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opcode != wsText || !strings.HasPrefix(string(payload), `{"id":"`+eventID(d.watch, 1)+`","event":"set","data":{`) {
+		t.Errorf("unexpected message %d %q", opcode, payload)
+	}
+}
+
+func TestWatchResume(t *testing.T) {
+	h := newTestHub(watchClientBuffer + 10)
+	for i := 0; i < watchClientBuffer+10; i++ {
+		h.publish(&watchEvent{kind: "set", key: "k00", data: []byte("{}")})
+	}
+
+	ahead := newWatchClient([]string{"k00"}, nil, nil)
+	if err := h.add(ahead, eventID(h, watchClientBuffer+20)); err != nil {
+		t.Fatal(err)
+	}
+	if e := receive(t, ahead); e.kind != "reset" {
+		t.Errorf("resuming from an event not sent yet should reset, got %s", e.kind)
+	}
+	h.remove(ahead)
+
+	behind := newWatchClient([]string{"k00"}, nil, nil)
+	if err := h.add(behind, eventID(h, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if e := receive(t, behind); e.kind != "reset" {
+		t.Errorf("replaying more events than the client can queue should reset, got %s", e.kind)
+	}
+
+	select {
+	case <-behind.done:
+		t.Error("client shouldn't be disconnected")
+	default:
+	}
+	h.remove(behind)
+
+	current := newWatchClient([]string{"k00"}, nil, nil)
+	if err := h.add(current, eventID(h, watchClientBuffer+10)); err != nil {
+		t.Fatal(err)
+	}
+	if len(current.out) != 0 {
+		t.Errorf("up to date clients shouldn't get any event, got %d", len(current.out))
+	}
+	h.remove(current)
+
+	// ids are numbered from 1 again after a restart
+	restarted := newWatchClient([]string{"k00"}, nil, nil)
+	if err := h.add(restarted, "l2k3j4-1"); err != nil {
+		t.Fatal(err)
+	}
+	if e := receive(t, restarted); e.kind != "reset" {
+		t.Errorf("resuming from an event sent before a restart should reset, got %s", e.kind)
+	}
+}
+
+func TestKeyspaceKey(t *testing.T) {
+	tests := []struct {
+		channel string
+		db      int
+		key     string
+		ok      bool
+	}{
+		{"__keyspace@0__:k00", 0, "k00", true},
+		{"__keyspace@12__:user:__1", 12, "user:__1", true},
+		{"__keyevent@0__:set", 0, "", false},
+		{"__keyspace@x__:k00", 0, "", false},
+	}
+
+	for _, tt := range tests {
+		db, key, ok := keyspaceKey(tt.channel)
+		if db != tt.db || key != tt.key || ok != tt.ok {
+			t.Errorf("keyspaceKey(%q) = %d, %q, %v", tt.channel, db, key, ok)
+		}
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	var buf bytes.Buffer
+	writeFrame(&buf, wsText, []byte("hi"))
+	if _, _, err := readFrame(bufio.NewReader(&buf)); err != errUnmaskedFrame {
+		t.Errorf("unmasked frames should be rejected, got %v", err)
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | wsText, 0x80 | 2}
+	frame = append(frame, mask...)
+	frame = append(frame, 'h'^mask[0], 'i'^mask[1])
+
+	opcode, payload, err := readFrame(bufio.NewReader(bytes.NewReader(frame)))
+	if err != nil || opcode != wsText || string(payload) != "hi" {
+		t.Errorf("unexpected frame %d %q %v", opcode, payload, err)
+	}
+}
+
+// readServerFrame reads an unmasked frame, as sent by servers.
+func readServerFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	n := int(header[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = int(binary.BigEndian.Uint64(ext[:]))
+	}
+
+	payload := make([]byte, n)
+	_, err := io.ReadFull(r, payload)
+	return header[0] & 0x0F, payload, err
+}
+
+func waitWatchers(t *testing.T, h *watchHub, n int) {
+	for i := 0; i < 100; i++ {
+		h.mu.Lock()
+		count := len(h.clients)
+		h.mu.Unlock()
+
+		if count == n {
+			return
+		}
+		<-time.After(time.Millisecond * 10)
+	}
+
+	t.Fatalf("expected %d watchers", n)
+}
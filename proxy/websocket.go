@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// wsGUID is appended to the key of a WebSocket handshake, RFC 6455 1.3.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+
+	// wsMaxFrame bounds the frames read from clients, which are only
+	// expected to send control frames.
+	wsMaxFrame = 64 * 1024
+
+	wsWriteTimeout = time.Second * 10
+)
+
+var (
+	errFrameTooBig   = errors.New("websocket frame too big")
+	errUnmaskedFrame = errors.New("websocket frame from client not masked")
+)
+
+// isWebSocket reports whether r asks to upgrade to a WebSocket.
+func isWebSocket(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") && strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// headerContains reports whether the comma separated values of the header
+// name include v, case insensitively.
+func headerContains(h http.Header, name string, v string) bool {
+	for _, line := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), v) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// wsAccept returns the Sec-WebSocket-Accept of a handshake with key.
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// upgradeWebSocket completes the handshake of a WebSocket, taking over the
+// connection. It writes the error reply itself if the handshake fails.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, *bufio.ReadWriter, error) {
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		w.WriteHeader(http.StatusUpgradeRequired)
+		return nil, nil, errors.New("unsupported websocket version")
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, nil, errors.New("missing websocket key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, nil, errors.New("connection can't be upgraded")
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", wsAccept(key))
+
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, rw, nil
+}
+
+// writeFrame writes an unmasked frame, as sent by servers.
+func writeFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode, 0}
+
+	n := len(payload)
+	switch {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := w.Write(payload)
+	return err
+}
+
+// readFrame reads a frame sent by a client, unmasking its payload. Clients
+// must mask their frames, RFC 6455 5.1. Fragmented messages are returned
+// frame by frame.
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	n := uint64(header[1] & 0x7F)
+
+	if !masked {
+		return 0, nil, errUnmaskedFrame
+	}
+
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if n > wsMaxFrame {
+		return 0, nil, errFrameTooBig
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return opcode, payload, nil
+}
+
+// wsConn is the connection of a WebSocket client, writes being serialized
+// between the events and the replies to control frames.
+type wsConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+	w    *bufio.Writer
+}
+
+func (c *wsConn) write(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := writeFrame(c.w, opcode, payload); err != nil {
+		return err
+	}
+
+	return c.w.Flush()
+}
+
+// serveWebSocket upgrades the connection and writes the events of c as JSON
+// text messages, pinging the client every heartbeat. Messages sent by the
+// client are ignored, except for control frames.
+func serveWebSocket(w http.ResponseWriter, r *http.Request, c *watchClient, heartbeat time.Duration) {
+	conn, rw, err := upgradeWebSocket(w, r)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"addr":  r.RemoteAddr,
+			"error": err,
+		}).Debug("error upgrading to websocket")
+		return
+	}
+	defer conn.Close()
+
+	ws := &wsConn{conn: conn, w: rw.Writer}
+
+	go func() {
+		defer c.close()
+
+		for {
+			opcode, payload, err := readFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+
+			switch opcode {
+			case wsClose:
+				ws.write(wsClose, payload)
+				return
+			case wsPing:
+				ws.write(wsPong, payload)
+			}
+		}
+	}()
+
+	t := time.NewTicker(heartbeat)
+	defer t.Stop()
+
+	for {
+		var err error
+		select {
+		case <-c.done:
+			ws.write(wsClose, nil)
+			return
+		case <-t.C:
+			err = ws.write(wsPing, nil)
+		case e := <-c.out:
+			msg := fmt.Sprintf(`{"event":%q,"data":%s}`, e.kind, e.data)
+			if e.id > 0 {
+				msg = fmt.Sprintf(`{"id":%q,"event":%q,"data":%s}`, e.eventID(), e.kind, e.data)
+			}
+			err = ws.write(wsText, []byte(msg))
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
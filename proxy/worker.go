@@ -2,7 +2,11 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-redis/redis"
 	log "github.com/sirupsen/logrus"
@@ -10,28 +14,123 @@ import (
 
 type stringCmd interface {
 	Result() (string, error)
+	// TTL is the remaining time to live of the key, -1 if it has none.
+	TTL() (time.Duration, error)
+}
+
+type sliceCmd interface {
+	Result() ([]interface{}, error)
+}
+
+type valueCmd interface {
+	Result() (interface{}, error)
+}
+
+type rangeCmd interface {
+	Result() (*valueRange, error)
 }
 
 type redisFetcher interface {
 	Get(key string) stringCmd
+	MGet(keys ...string) sliceCmd
+	GetRange(key string, start int64, end int64) rangeCmd
+	Do(args ...interface{}) valueCmd
 	Close() error
 }
 
+// valueRange is a range of bytes of a string value, along with the length
+// of the whole value and its first bytes to sniff its content type from.
+type valueRange struct {
+	part string
+	head string
+	n    int64
+}
+
 type stringCmdImpl struct {
-	s *redis.StringCmd
+	s   *redis.StringCmd
+	ttl *redis.IntCmd
 }
 
 func (sc *stringCmdImpl) Result() (string, error) {
 	return sc.s.Result()
 }
 
+func (sc *stringCmdImpl) TTL() (time.Duration, error) {
+	n, err := sc.ttl.Result()
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 0 {
+		return -1, nil
+	}
+
+	return time.Duration(n) * time.Millisecond, nil
+}
+
 type redisFetcherImpl struct {
 	c *redis.Client
 }
 
+// Get reads the key along with its PTTL, pipelined in a single round trip.
 func (rf *redisFetcherImpl) Get(key string) stringCmd {
-	sc := rf.c.Get(key)
-	return &stringCmdImpl{sc}
+	pipe := rf.c.Pipeline()
+	sc := pipe.Get(key)
+	ttl := redis.NewIntCmd("pttl", key)
+	pipe.Process(ttl)
+	pipe.Exec()
+
+	return &stringCmdImpl{sc, ttl}
+}
+
+func (rf *redisFetcherImpl) MGet(keys ...string) sliceCmd {
+	return rf.c.MGet(keys...)
+}
+
+type rangeCmdImpl struct {
+	n    *redis.IntCmd
+	part *redis.StringCmd
+	head *redis.StringCmd
+}
+
+func (rc *rangeCmdImpl) Result() (*valueRange, error) {
+	n, err := rc.n.Result()
+	if err != nil {
+		return nil, err
+	}
+
+	part, err := rc.part.Result()
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := rc.head.Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return &valueRange{part, head, n}, nil
+}
+
+// GetRange reads the bytes of the key from start to end like GETRANGE,
+// along with its STRLEN and first bytes, in a transaction so they all come
+// from the same value.
+func (rf *redisFetcherImpl) GetRange(key string, start int64, end int64) rangeCmd {
+	pipe := rf.c.TxPipeline()
+	rc := &rangeCmdImpl{
+		n:    pipe.StrLen(key),
+		part: pipe.GetRange(key, start, end),
+		head: pipe.GetRange(key, 0, sniffLen-1),
+	}
+	pipe.Exec()
+
+	return rc
+}
+
+func (rf *redisFetcherImpl) Do(args ...interface{}) valueCmd {
+	cmd := redis.NewCmd(args...)
+	rf.c.Process(cmd)
+	return cmd
 }
 
 func (rf *redisFetcherImpl) Close() error {
@@ -41,16 +140,122 @@ func (rf *redisFetcherImpl) Close() error {
 type response struct {
 	code int
 	body string
+	val  interface{}
+	meta *keyMeta
+	err  error
+
+	// hit is set when the reply was served from the cache, at is when it
+	// was read from redis and exp when it expires from the cache.
+	hit bool
+	at  time.Time
+	exp time.Time
+}
+
+// cached returns the response of a reply cached in e.
+func cached(e *entry) *response {
+	return &response{
+		code: http.StatusOK,
+		val:  e.val,
+		meta: e.meta,
+		hit:  true,
+		at:   e.at,
+		exp:  e.exp,
+	}
+}
+
+// errorResponse maps an error querying redis to a response.
+func errorResponse(err error) *response {
+	code := http.StatusBadGateway
+	if err == context.DeadlineExceeded {
+		code = http.StatusGatewayTimeout
+	}
+
+	return &response{
+		code: code,
+		err:  err,
+	}
 }
 
 type Job struct {
+	ctx context.Context
 	res chan *response
 	key string
+	// db is the redis database the job runs on.
+	db int
+
+	// cmd and args describe jobs other than a single GET of key. A range
+	// job reads the bytes of key between the offsets in args, see
+	// worker.getRange.
+	cmd  string
+	args []string
+
+	// noCache skips the cache lookup, the reply being fetched from redis,
+	// and maxStale accepts entries expired for up to that long, or for
+	// any time if negative.
+	noCache  bool
+	maxStale time.Duration
+
+	// items, when set, receives each value of an MGET as soon as it's
+	// known, before the whole response. It must have room for all of
+	// them.
+	items chan item
+}
+
+// item is the value of the i-th key of an MGET, or the error fetching it.
+type item struct {
+	i   int
+	val interface{}
+	err error
+}
+
+func newJob(ctx context.Context, key string) Job {
+	return Job{
+		ctx: ctx,
+		res: make(chan *response, 1),
+		key: key,
+	}
+}
+
+func newRangeJob(ctx context.Context, key string, start int64, end int64) Job {
+	return Job{
+		ctx:  ctx,
+		res:  make(chan *response, 1),
+		key:  key,
+		cmd:  "range",
+		args: []string{strconv.FormatInt(start, 10), strconv.FormatInt(end, 10)},
+	}
+}
+
+func newCmdJob(ctx context.Context, cmd string, args ...string) Job {
+	return Job{
+		ctx:  ctx,
+		res:  make(chan *response, 1),
+		cmd:  cmd,
+		args: args,
+	}
+}
+
+// send reports an item of the job, if it asked for them.
+func (job Job) send(it item) {
+	if job.items != nil {
+		job.items <- it
+	}
 }
 
 type worker struct {
-	client redisFetcher
-	cache  *cache
+	client  redisFetcher
+	cache   *cache
+	scripts *scripts
+
+	// db is the database client is bound to, clients for the other
+	// databases are opened with dial when first needed.
+	db      int
+	dial    func(db int) redisFetcher
+	clients map[int]redisFetcher
+
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
 
 	workers chan chan Job
 	jobs    chan Job
@@ -59,6 +264,9 @@ type worker struct {
 func (w *worker) run(ctx context.Context) {
 	defer func() {
 		w.client.Close()
+		for _, c := range w.clients {
+			c.Close()
+		}
 	}()
 
 	for {
@@ -68,53 +276,619 @@ func (w *worker) run(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case job := <-w.jobs:
-			v := w.cache.get(job.key)
-			if v != "" {
-				job.res <- &response{
-					code: http.StatusOK,
-					body: v,
-				}
-				continue
-			}
-
-			v, err := w.client.Get(job.key).Result()
-			if err != nil {
+			if err := job.ctx.Err(); err != nil {
 				log.WithFields(log.Fields{
 					"key":   job.key,
 					"error": err,
-				}).Error("error while querying redis")
-
-				job.res <- &response{
-					code: http.StatusNotFound,
-				}
+				}).Debug("job expired while waiting for a worker")
 				continue
 			}
 
+			switch job.cmd {
+			case "":
+				w.get(job)
+			case "mget":
+				w.mget(job)
+			case "range":
+				w.getRange(job)
+			default:
+				w.do(job)
+			}
+		}
+	}
+}
+
+// conn returns the client bound to db.
+func (w *worker) conn(db int) redisFetcher {
+	if db == w.db {
+		return w.client
+	}
+
+	c, ok := w.clients[db]
+	if !ok {
+		c = w.dial(db)
+		if w.clients == nil {
+			w.clients = make(map[int]redisFetcher)
+		}
+		w.clients[db] = c
+	}
+
+	return c
+}
+
+// errWrongType is replied to a GET of a key holding something other than
+// a string.
+var errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// get replies with the value of a string key. Keys of other types are
+// cached with their type only, and replied with errWrongType along with
+// their metadata.
+func (w *worker) get(job Job) {
+	k := dbKey(job.db, job.key)
+	if e, ok := w.lookup(job, k); ok {
+		if e.meta != nil && e.meta.kind != "string" {
+			job.res <- &response{
+				code: http.StatusConflict,
+				meta: e.meta,
+				err:  errWrongType,
+			}
+			return
+		}
+
+		if v, _ := e.val.(string); v != "" {
+			res := cached(e)
+			res.body = v
+			job.res <- res
+			return
+		}
+	}
+
+	gen := w.cache.generation(k)
+
+	var v string
+	var meta *keyMeta
+	err := w.retry(job, func() error {
+		cmd := w.conn(job.db).Get(job.key)
+
+		var err error
+		v, err = cmd.Result()
+		if err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE") {
+			meta = w.keyType(job, cmd)
+			return err
+		}
+
+		if err != nil {
+			return err
+		}
+
+		meta = nil
+		if ttl, err := cmd.TTL(); err == nil {
+			meta = newKeyMeta("string", ttl)
+		}
+		return nil
+	})
+	if err != nil && meta != nil {
+		w.cache.setMeta(k, nil, meta, gen)
+		job.res <- &response{
+			code: http.StatusConflict,
+			meta: meta,
+			err:  errWrongType,
+		}
+		return
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"key":   job.key,
+			"error": err,
+		}).Error("error while querying redis")
+
+		if err == redis.Nil {
+			job.res <- &response{
+				code: http.StatusNotFound,
+				err:  err,
+			}
+			return
+		}
+
+		job.res <- errorResponse(err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"key":   job.key,
+		"value": v,
+	}).Debug("key fetched from redis")
+
+	e := w.cache.setMeta(k, v, meta, gen)
+	job.res <- &response{
+		code: http.StatusOK,
+		body: v,
+		meta: meta,
+		at:   e.at,
+		exp:  e.exp,
+	}
+}
+
+// lookup returns the entry cached for k, following the cache directives
+// of the job.
+func (w *worker) lookup(job Job, k string) (*entry, bool) {
+	if job.noCache {
+		return nil, false
+	}
+
+	return w.cache.lookupStale(k, job.maxStale)
+}
+
+// keyType returns the metadata of a key GET failed on for not being a
+// string, nil if its TYPE can't be read.
+func (w *worker) keyType(job Job, cmd stringCmd) *keyMeta {
+	kind, err := w.conn(job.db).Do("type", job.key).Result()
+	if err != nil {
+		return nil
+	}
+
+	ttl, err := cmd.TTL()
+	if err != nil {
+		return nil
+	}
+
+	s, _ := kind.(string)
+	return newKeyMeta(s, ttl)
+}
+
+// getRange replies with a *valueRange of the key, sliced from its cached
+// value if there's one, or else read from redis.
+func (w *worker) getRange(job Job) {
+	start, _ := strconv.ParseInt(job.args[0], 10, 64)
+	end, _ := strconv.ParseInt(job.args[1], 10, 64)
+
+	if e, ok := w.lookup(job, dbKey(job.db, job.key)); ok {
+		if s, ok := e.val.(string); ok {
+			res := cached(e)
+			res.val = &valueRange{byteRange(s, start, end), byteRange(s, 0, sniffLen-1), int64(len(s))}
+			job.res <- res
+			return
+		}
+	}
+
+	var v *valueRange
+	err := w.retry(job, func() error {
+		var err error
+		v, err = w.conn(job.db).GetRange(job.key, start, end).Result()
+		return err
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"key":   job.key,
+			"error": err,
+		}).Error("error while querying redis")
+
+		job.res <- errorResponse(err)
+		return
+	}
+
+	job.res <- &response{
+		code: http.StatusOK,
+		val:  v,
+	}
+}
+
+// mget serves the keys found in cache and fetches the rest from redis with a
+// single MGET, returning the values in the order they were requested.
+func (w *worker) mget(job Job) {
+	vals := make([]interface{}, len(job.args))
+	missing := []string{}
+	idx := []int{}
+
+	for i, k := range job.args {
+		if v := w.cache.get(dbKey(job.db, k)); v != "" {
+			vals[i] = v
+			job.send(item{i, v, nil})
+			continue
+		}
+
+		missing = append(missing, k)
+		idx = append(idx, i)
+	}
+
+	if len(missing) > 0 {
+		gens := make([]uint64, len(missing))
+		for i, k := range missing {
+			gens[i] = w.cache.generation(dbKey(job.db, k))
+		}
+
+		var fetched []interface{}
+		err := w.retry(job, func() error {
+			var err error
+			fetched, err = w.conn(job.db).MGet(missing...).Result()
+			return err
+		})
+		if err != nil {
 			log.WithFields(log.Fields{
-				"key":   job.key,
-				"value": v,
-			}).Debug("key fetched from redis")
+				"keys":  missing,
+				"error": err,
+			}).Error("error while querying redis")
+
+			for _, i := range idx {
+				job.send(item{i, nil, err})
+			}
+
+			job.res <- errorResponse(err)
+			return
+		}
+
+		for i, v := range fetched {
+			s, ok := v.(string)
+			if !ok {
+				job.send(item{idx[i], nil, nil})
+				continue
+			}
 
-			w.cache.set(job.key, v)
+			vals[idx[i]] = s
+			w.cache.setValue(dbKey(job.db, missing[i]), s, gens[i])
+			job.send(item{idx[i], s, nil})
+		}
+
+		log.WithFields(log.Fields{
+			"keys":   len(job.args),
+			"cached": len(job.args) - len(missing),
+		}).Debug("keys fetched from redis")
+	}
+
+	job.res <- &response{
+		code: http.StatusOK,
+		val:  vals,
+	}
+}
+
+// do runs any other command in the command table. Replies of cached
+// commands are served from and saved to the cache, writes invalidate the
+// keys they touch.
+func (w *worker) do(job Job) {
+	spec := commandTable[job.cmd]
+	args := append([]string{job.cmd}, job.args...)
+
+	if spec.flags&cmdScript != 0 {
+		w.script(job, args)
+		return
+	}
+
+	if spec.flags&cmdMeta != 0 {
+		if v, ok := w.fromMeta(job.db, args); ok {
 			job.res <- &response{
 				code: http.StatusOK,
-				body: v,
+				val:  v,
 			}
+			return
+		}
+	}
+
+	var k string
+	if spec.flags&cmdCached != 0 {
+		k = dbKey(job.db, derivedKey(args))
+		if e, ok := w.lookup(job, k); ok {
+			job.res <- cached(e)
+			return
+		}
+	}
+
+	cmdArgs := stringArgs(args)
+	gen := w.cache.generation(dbKeys(job.db, commandKeys(args))...)
+
+	var v interface{}
+	query := func() error {
+		var err error
+		v, err = w.conn(job.db).Do(cmdArgs...).Result()
+		if err == redis.Nil {
+			v, err = nil, nil
 		}
+		return err
+	}
+
+	var err error
+	if spec.flags&cmdWrite != 0 {
+		// writes aren't idempotent, so they are never retried
+		err = query()
+		invalidateCommand(w.cache, job.db, args)
+		if err == nil {
+			writeThrough(w.cache, job.db, args, gen)
+		}
+	} else {
+		err = w.retry(job, query)
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cmd":   job.cmd,
+			"error": err,
+		}).Error("error while querying redis")
+
+		job.res <- errorResponse(err)
+		return
 	}
+
+	res := &response{
+		code: http.StatusOK,
+		val:  v,
+	}
+
+	if k != "" {
+		e := w.cache.setValue(k, v, gen, dbKey(job.db, args[1]))
+		res.at, res.exp = e.at, e.exp
+	}
+
+	job.res <- res
 }
 
-func newWorker(redisAddr string, cache *cache, workers chan chan Job) (*worker, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr: redisAddr,
-	})
+// script runs EVAL, EVALSHA and SCRIPT. EVALSHA is retried with EVAL when
+// redis doesn't know the script but the proxy does. The results of scripts
+// marked as cacheable are cached under their SHA, keys and args, and
+// invalidated with their keys, other scripts are assumed to write them.
+func (w *worker) script(job Job, args []string) {
+	var sha string
+	switch args[0] {
+	case "eval":
+		sha = w.scripts.add(args[1])
+	case "evalsha":
+		sha = strings.ToLower(args[1])
+	}
+
+	keys := commandKeys(args)
+	ttl, cacheable := w.scripts.ttl(sha)
+
+	var k string
+	if cacheable {
+		k = dbKey(job.db, derivedKey(append([]string{"evalsha", sha}, args[2:]...)))
+		if v, ok := w.cache.getValue(k); ok {
+			job.res <- &response{
+				code: http.StatusOK,
+				val:  v,
+			}
+			return
+		}
+	}
+
+	// results of scripts without keys have the generation of their own
+	// key, see entry.keys
+	genKeys := dbKeys(job.db, keys)
+	if len(genKeys) == 0 {
+		genKeys = []string{k}
+	}
+	gen := w.cache.generation(genKeys...)
+
+	var v interface{}
+	query := func() error {
+		var err error
+		v, err = w.conn(job.db).Do(stringArgs(args)...).Result()
+		if err != nil && args[0] == "evalsha" && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+			if body, ok := w.scripts.body(sha); ok {
+				log.WithFields(log.Fields{
+					"sha": sha,
+				}).Debug("script not loaded in redis, retrying with its body")
+
+				evalArgs := append([]string{"eval", body}, args[2:]...)
+				v, err = w.conn(job.db).Do(stringArgs(evalArgs)...).Result()
+			}
+		}
+
+		if err == redis.Nil {
+			v, err = nil, nil
+		}
+		return err
+	}
+
+	var err error
+	if cacheable {
+		err = w.retry(job, query)
+	} else {
+		err = query()
+		w.cache.invalidate(dbKeys(job.db, keys)...)
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cmd":   job.cmd,
+			"error": err,
+		}).Error("error while querying redis")
+
+		job.res <- errorResponse(err)
+		return
+	}
+
+	if args[0] == "script" && strings.ToLower(args[1]) == "load" && len(args) == 3 {
+		w.scripts.add(args[2])
+	}
+
+	if cacheable {
+		w.cache.setExpiring(k, v, ttl, gen, dbKeys(job.db, keys)...)
+	}
+
+	job.res <- &response{
+		code: http.StatusOK,
+		val:  v,
+	}
+}
+
+// fromMeta answers EXISTS, TYPE, STRLEN, TTL and PTTL from the metadata of
+// cached keys, and GETRANGE and SUBSTR from their values, reporting false
+// if any of the keys isn't known.
+func (w *worker) fromMeta(db int, args []string) (interface{}, bool) {
+	if args[0] == "exists" {
+		for _, k := range args[1:] {
+			if e, ok := w.cache.lookup(dbKey(db, k)); !ok || e.meta == nil {
+				return nil, false
+			}
+		}
+
+		return int64(len(args) - 1), true
+	}
+
+	e, ok := w.cache.lookup(dbKey(db, args[1]))
+	if !ok || e.meta == nil {
+		return nil, false
+	}
+
+	switch args[0] {
+	case "type":
+		return e.meta.kind, true
+	case "strlen":
+		s, ok := e.val.(string)
+		return int64(len(s)), ok
+	case "getrange", "substr":
+		s, ok := e.val.(string)
+		start, err1 := strconv.ParseInt(args[2], 10, 64)
+		end, err2 := strconv.ParseInt(args[3], 10, 64)
+		if !ok || err1 != nil || err2 != nil {
+			// redis replies with the error
+			return nil, false
+		}
+		return byteRange(s, start, end), true
+	case "ttl":
+		return e.meta.ttlSeconds(time.Now()), true
+	case "pttl":
+		ttl := e.meta.ttl(time.Now())
+		if ttl < 0 {
+			return int64(-1), true
+		}
+		return int64(ttl / time.Millisecond), true
+	}
+
+	return nil, false
+}
+
+// byteRange returns the bytes of s from start to end, both included, with
+// the semantics of GETRANGE: negative offsets count from the end, and the
+// range is clamped to the string.
+func byteRange(s string, start int64, end int64) string {
+	n := int64(len(s))
+	if start < 0 && end < 0 && start > end {
+		return ""
+	}
+
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= n {
+		end = n - 1
+	}
+
+	if start > end || n == 0 {
+		return ""
+	}
+
+	return s[start : end+1]
+}
+
+// invalidateCommand drops from the cache what the write command in args
+// touched on db, FLUSHDB and FLUSHALL clearing whole databases.
+func invalidateCommand(c *cache, db int, args []string) {
+	switch args[0] {
+	case "flushdb":
+		c.flush(db)
+	case "flushall":
+		c.flush(-1)
+	default:
+		c.invalidate(dbKeys(db, commandKeys(args))...)
+	}
+}
+
+// writeThrough caches the value written by a SET, optionally with EX or
+// PX, so the next GET of the key is a hit. SETs with other options may not
+// write, so they're only invalidated. gen is the generation of the key
+// before the SET, the value is only cached if nothing but the SET itself
+// invalidated the key since, as another write may have landed after it.
+func writeThrough(c *cache, db int, args []string, gen uint64) {
+	if args[0] != "set" {
+		return
+	}
+
+	ttl := time.Duration(-1)
+	switch len(args) {
+	case 3:
+	case 5:
+		n, err := strconv.ParseInt(args[4], 10, 64)
+		if err != nil || n <= 0 {
+			return
+		}
+
+		switch strings.ToLower(args[3]) {
+		case "ex":
+			ttl = time.Duration(n) * time.Second
+		case "px":
+			ttl = time.Duration(n) * time.Millisecond
+		default:
+			return
+		}
+	default:
+		return
+	}
+
+	c.setMeta(dbKey(db, args[1]), args[2], newKeyMeta("string", ttl), gen+1)
+}
+
+// retry runs fn, retrying network errors with backoff for as long as the
+// job's deadline allows.
+func (w *worker) retry(job Job, fn func() error) error {
+	var err error
+	for attempt := 0; attempt <= w.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-job.ctx.Done():
+				return job.ctx.Err()
+			case <-time.After(backoff(attempt, w.minBackoff, w.maxBackoff)):
+			}
+
+			log.WithFields(log.Fields{
+				"cmd":     job.cmd,
+				"attempt": attempt,
+			}).Debug("retrying redis query")
+		}
+
+		err = fn()
+		if err == nil || !retryable(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+func newWorker(redisAddr string, opts UpstreamOptions, cache *cache, scripts *scripts, workers chan chan Job) (*worker, error) {
+	client := redis.NewClient(opts.redisOptions(redisAddr))
 
 	ci := &redisFetcherImpl{client}
 
+	// a worker runs one query at a time, a single connection per database
+	// is all it needs
+	dial := func(db int) redisFetcher {
+		o := opts
+		o.DB = db
+		o.PoolSize = 1
+		return &redisFetcherImpl{redis.NewClient(o.redisOptions(redisAddr))}
+	}
+
 	return &worker{
 		jobs:    make(chan Job),
 		workers: workers,
 		cache:   cache,
+		scripts: scripts,
 		client:  ci,
+		db:      opts.DB,
+		dial:    dial,
+
+		retries:    opts.MaxRetries,
+		minBackoff: opts.MinRetryBackoff,
+		maxBackoff: opts.MaxRetryBackoff,
 	}, nil
 }
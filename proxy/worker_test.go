@@ -2,11 +2,16 @@ package proxy
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
+	"net"
 	"net/http"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/go-redis/redis"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 )
@@ -20,6 +25,29 @@ func (m *stringCmdMock) Result() (string, error) {
 	return args.String(0), args.Error(1)
 }
 
+func (m *stringCmdMock) TTL() (time.Duration, error) {
+	args := m.Called()
+	return args.Get(0).(time.Duration), args.Error(1)
+}
+
+type sliceCmdMock struct {
+	mock.Mock
+}
+
+func (m *sliceCmdMock) Result() ([]interface{}, error) {
+	args := m.Called()
+	return args.Get(0).([]interface{}), args.Error(1)
+}
+
+type valueCmdMock struct {
+	mock.Mock
+}
+
+func (m *valueCmdMock) Result() (interface{}, error) {
+	args := m.Called()
+	return args.Get(0), args.Error(1)
+}
+
 type redisFetcherMock struct {
 	mock.Mock
 }
@@ -29,11 +57,31 @@ func (m *redisFetcherMock) Get(key string) stringCmd {
 	return args.Get(0).(stringCmd)
 }
 
+func (m *redisFetcherMock) MGet(keys ...string) sliceCmd {
+	args := m.Called(keys)
+	return args.Get(0).(sliceCmd)
+}
+
+func (m *redisFetcherMock) GetRange(key string, start int64, end int64) rangeCmd {
+	args := m.Called(key, start, end)
+	return args.Get(0).(rangeCmd)
+}
+
+func (m *redisFetcherMock) Do(args ...interface{}) valueCmd {
+	a := m.Called(args)
+	return a.Get(0).(valueCmd)
+}
+
 func (m *redisFetcherMock) Close() error {
 	args := m.Called()
 	return args.Error(0)
 }
 
+const (
+	testScript    = "return redis.call('get', KEYS[1])"
+	testScriptSHA = "4e6d8fc8bb01276962cce5371fa795a7763657ae"
+)
+
 // SuiteWorker
 type SuiteWorker struct {
 	suite.Suite
@@ -55,6 +103,9 @@ func (s *SuiteWorker) SetupTest() {
 		jobs:    make(chan Job),
 		workers: s.ws,
 		cache:   s.c,
+		scripts: newScripts(map[string]time.Duration{
+			testScriptSHA: time.Second,
+		}),
 	}
 }
 
@@ -65,7 +116,7 @@ func (s *SuiteWorker) TearDownTestSuite() {
 
 func (s *SuiteWorker) BeforeTest(suite, test string) {
 	if test == "TestCachedRun" {
-		s.c.set("k00", "v00")
+		s.c.set(dbKey(0, "k00"), "v00")
 		<-time.After(time.Millisecond * 5)
 		return
 	}
@@ -73,10 +124,11 @@ func (s *SuiteWorker) BeforeTest(suite, test string) {
 	if test == "TestRun" {
 		scSuccess := new(stringCmdMock)
 		scSuccess.On("Result").Return("v00", nil)
+		scSuccess.On("TTL").Return(time.Duration(-1), nil)
 		scSuccess.On("Close").Return(nil)
 
 		scError := new(stringCmdMock)
-		scError.On("Result").Return("", errors.New("redis: nil"))
+		scError.On("Result").Return("", redis.Nil)
 		scError.On("Close").Return(nil)
 
 		rf := new(redisFetcherMock)
@@ -86,6 +138,131 @@ func (s *SuiteWorker) BeforeTest(suite, test string) {
 		s.w.client = rf
 		return
 	}
+
+	if test == "TestMGetRun" {
+		s.c.set(dbKey(0, "k00"), "v00")
+		<-time.After(time.Millisecond * 5)
+
+		scMGet := new(sliceCmdMock)
+		scMGet.On("Result").Return([]interface{}{"v01", nil}, nil)
+
+		rf := new(redisFetcherMock)
+		rf.On("MGet", []string{"k01", "k02"}).Return(scMGet)
+
+		s.w.client = rf
+		return
+	}
+
+	if test == "TestCachedCommandRun" {
+		scHGet := new(valueCmdMock)
+		scHGet.On("Result").Return("v00", nil)
+
+		scHSet := new(valueCmdMock)
+		scHSet.On("Result").Return(int64(0), nil)
+
+		rf := new(redisFetcherMock)
+		rf.On("Do", []interface{}{"hget", "h00", "f00"}).Return(scHGet)
+		rf.On("Do", []interface{}{"hset", "h00", "f00", "v01"}).Return(scHSet)
+
+		s.w.client = rf
+		return
+	}
+
+	if test == "TestScriptRun" {
+		sha := s.w.scripts.add(testScript)
+
+		scNoScript := new(valueCmdMock)
+		scNoScript.On("Result").Return(nil, errors.New("NOSCRIPT No matching script. Please use EVAL."))
+
+		scEval := new(valueCmdMock)
+		scEval.On("Result").Return("v00", nil)
+
+		scSet := new(valueCmdMock)
+		scSet.On("Result").Return("OK", nil)
+
+		rf := new(redisFetcherMock)
+		rf.On("Do", []interface{}{"evalsha", sha, "1", "k00"}).Return(scNoScript)
+		rf.On("Do", []interface{}{"eval", testScript, "1", "k00"}).Return(scEval)
+		rf.On("Do", []interface{}{"set", "k00", "v01"}).Return(scSet)
+
+		s.w.client = rf
+		return
+	}
+
+	if test == "TestDBRun" {
+		scFlush := new(valueCmdMock)
+		scFlush.On("Result").Return("OK", nil)
+
+		db3 := new(redisFetcherMock)
+		db3.On("Do", []interface{}{"flushdb"}).Return(scFlush)
+		db3.On("Close").Return(nil)
+
+		s.w.client = new(redisFetcherMock)
+		s.w.dial = func(db int) redisFetcher {
+			s.Equal(3, db, "clients should be bound to the job's database")
+			return db3
+		}
+		return
+	}
+
+	if test == "TestWrongTypeRun" {
+		scWrongType := new(stringCmdMock)
+		scWrongType.On("Result").Return("", errors.New("WRONGTYPE Operation against a key holding the wrong kind of value"))
+		scWrongType.On("TTL").Return(time.Duration(-1), nil)
+
+		scType := new(valueCmdMock)
+		scType.On("Result").Return("hash", nil)
+
+		rf := new(redisFetcherMock)
+		rf.On("Get", "h00").Return(scWrongType).Once()
+		rf.On("Do", []interface{}{"type", "h00"}).Return(scType).Once()
+
+		s.w.client = rf
+		return
+	}
+
+	if test == "TestMetaRun" {
+		scExists := new(valueCmdMock)
+		scExists.On("Result").Return(int64(1), nil)
+
+		rf := new(redisFetcherMock)
+		rf.On("Do", []interface{}{"exists", "k00", "k02"}).Return(scExists)
+
+		s.w.client = rf
+		return
+	}
+
+	if test == "TestRetryRun" || test == "TestTimeoutRun" || test == "TestUpstreamErrorRun" {
+		scSuccess := new(stringCmdMock)
+		scSuccess.On("Result").Return("v02", nil)
+		scSuccess.On("TTL").Return(time.Duration(-1), nil)
+
+		scNetError := new(stringCmdMock)
+		scNetError.On("Result").Return("", &net.OpError{Op: "read", Err: errors.New("connection reset")})
+
+		rf := new(redisFetcherMock)
+		rf.On("Get", "k02").Return(scNetError).Once()
+		rf.On("Get", "k02").Return(scSuccess)
+
+		s.w.client = rf
+		s.w.retries = 2
+		s.w.minBackoff = time.Millisecond
+		s.w.maxBackoff = time.Millisecond * 5
+
+		if test == "TestUpstreamErrorRun" {
+			rf = new(redisFetcherMock)
+			rf.On("Get", "k02").Return(scNetError)
+			s.w.client = rf
+		}
+
+		if test == "TestTimeoutRun" {
+			// backoffs are jittered down to 0, make waiting less than the
+			// timeout of the job unlikely
+			s.w.minBackoff = time.Hour
+			s.w.maxBackoff = time.Hour
+		}
+		return
+	}
 }
 
 func (s *SuiteWorker) TestRun() {
@@ -94,6 +271,7 @@ func (s *SuiteWorker) TestRun() {
 	res := make(chan *response)
 	w := <-s.ws
 	w <- Job{
+		ctx: s.ctx,
 		key: "k00",
 		res: res,
 	}
@@ -104,6 +282,7 @@ func (s *SuiteWorker) TestRun() {
 
 	w = <-s.ws
 	w <- Job{
+		ctx: s.ctx,
 		key: "k01",
 		res: res,
 	}
@@ -119,6 +298,7 @@ func (s *SuiteWorker) TestCachedRun() {
 
 	res := make(chan *response)
 	w <- Job{
+		ctx: s.ctx,
 		key: "k00",
 		res: res,
 	}
@@ -129,6 +309,239 @@ func (s *SuiteWorker) TestCachedRun() {
 	s.Equal("v00", r.body, "cache response should match value")
 }
 
+func (s *SuiteWorker) TestRetryRun() {
+	go s.w.run(s.ctx)
+	w := <-s.ws
+
+	res := make(chan *response)
+	w <- Job{
+		ctx: s.ctx,
+		key: "k02",
+		res: res,
+	}
+
+	r := <-res
+
+	s.Equal(http.StatusOK, r.code, "should be 200")
+	s.Equal("v02", r.body, "redis response should match value after retry")
+}
+
+func (s *SuiteWorker) TestUpstreamErrorRun() {
+	go s.w.run(s.ctx)
+	w := <-s.ws
+
+	res := make(chan *response)
+	w <- Job{
+		ctx: s.ctx,
+		key: "k02",
+		res: res,
+	}
+
+	r := <-res
+
+	s.Equal(http.StatusBadGateway, r.code, "an unreachable redis isn't a missing key")
+	s.Equal("", r.body, "response should be empty")
+}
+
+func (s *SuiteWorker) TestTimeoutRun() {
+	go s.w.run(s.ctx)
+	w := <-s.ws
+
+	ctx, cancel := context.WithTimeout(s.ctx, time.Millisecond*10)
+	defer cancel()
+
+	res := make(chan *response)
+	w <- Job{
+		ctx: ctx,
+		key: "k02",
+		res: res,
+	}
+
+	r := <-res
+
+	s.Equal(http.StatusGatewayTimeout, r.code, "should be 504")
+	s.Equal("", r.body, "response should be empty")
+}
+
+func (s *SuiteWorker) TestMGetRun() {
+	go s.w.run(s.ctx)
+	w := <-s.ws
+
+	job := newCmdJob(s.ctx, "mget", "k00", "k01", "k02")
+	w <- job
+
+	r := <-job.res
+
+	s.Equal(http.StatusOK, r.code, "should be 200")
+	s.Equal([]interface{}{"v00", "v01", nil}, r.val, "values should be in the requested order")
+
+	<-time.After(time.Millisecond * 5)
+	s.Equal("v01", s.c.get(dbKey(0, "k01")), "fetched keys should be cached")
+}
+
+func (s *SuiteWorker) TestCachedCommandRun() {
+	go s.w.run(s.ctx)
+
+	run := func(cmd string, args ...string) *response {
+		job := newCmdJob(s.ctx, cmd, args...)
+		<-s.ws <- job
+		return <-job.res
+	}
+
+	r := run("hget", "h00", "f00")
+	s.Equal("v00", r.val, "redis response should match value")
+
+	<-time.After(time.Millisecond * 5)
+	v, ok := s.c.getValue(dbKey(0, derivedKey([]string{"hget", "h00", "f00"})))
+	s.True(ok, "reply should be cached")
+	s.Equal("v00", v, "cached reply should match value")
+
+	r = run("hget", "h00", "f00")
+	s.Equal("v00", r.val, "cached response should match value")
+	s.w.client.(*redisFetcherMock).AssertNumberOfCalls(s.T(), "Do", 1)
+
+	r = run("hset", "h00", "f00", "v01")
+	s.Equal(int64(0), r.val, "writes should be forwarded")
+
+	_, ok = s.c.getValue(dbKey(0, derivedKey([]string{"hget", "h00", "f00"})))
+	s.False(ok, "writes should invalidate derived entries")
+}
+
+func (s *SuiteWorker) TestMetaRun() {
+	go s.w.run(s.ctx)
+
+	run := func(cmd string, args ...string) *response {
+		job := newCmdJob(s.ctx, cmd, args...)
+		<-s.ws <- job
+		return <-job.res
+	}
+
+	s.c.setMeta(dbKey(0, "k00"), "v00", newKeyMeta("string", -1), s.c.generation(dbKey(0, "k00")))
+	s.c.setMeta(dbKey(0, "k01"), "value", newKeyMeta("string", time.Second*10), s.c.generation(dbKey(0, "k01")))
+	<-time.After(time.Millisecond * 5)
+
+	s.Equal(int64(2), run("exists", "k00", "k01").val, "cached keys should exist")
+	s.Equal("string", run("type", "k00").val, "type should come from the cache")
+	s.Equal(int64(5), run("strlen", "k01").val, "length should come from the cached value")
+	s.Equal(int64(-1), run("ttl", "k00").val, "keys without expiry should have a ttl of -1")
+	s.Equal(int64(10), run("ttl", "k01").val, "ttl should be rounded to seconds")
+
+	s.Equal("alu", run("getrange", "k01", "1", "-2").val, "ranges should be sliced from the cached value")
+	s.Equal("value", run("substr", "k01", "0", "100").val, "ranges should be clamped to the value")
+
+	pttl := run("pttl", "k01").val.(int64)
+	s.True(pttl > 9000 && pttl <= 10000, "pttl should be in milliseconds")
+	s.w.client.(*redisFetcherMock).AssertNotCalled(s.T(), "Do", []interface{}{"ttl", "k00"})
+
+	r := run("exists", "k00", "k02")
+	s.Equal(int64(1), r.val, "unknown keys should be forwarded")
+}
+
+func (s *SuiteWorker) TestWrongTypeRun() {
+	go s.w.run(s.ctx)
+
+	for i := 0; i < 2; i++ {
+		job := newJob(s.ctx, "h00")
+		<-s.ws <- job
+
+		r := <-job.res
+		s.Equal(errWrongType, r.err, "GET of a hash should be a WRONGTYPE error")
+		if s.NotNil(r.meta) {
+			s.Equal("hash", r.meta.kind, "the key's type should be returned")
+		}
+
+		<-time.After(time.Millisecond * 5)
+	}
+
+	s.w.client.(*redisFetcherMock).AssertExpectations(s.T())
+}
+
+func (s *SuiteWorker) TestScriptRun() {
+	go s.w.run(s.ctx)
+
+	run := func(cmd string, args ...string) *response {
+		job := newCmdJob(s.ctx, cmd, args...)
+		<-s.ws <- job
+		return <-job.res
+	}
+
+	r := run("evalsha", testScriptSHA, "1", "k00")
+	s.Equal("v00", r.val, "unknown scripts should be retried with their body")
+
+	<-time.After(time.Millisecond * 5)
+	r = run("evalsha", testScriptSHA, "1", "k00")
+	s.Equal("v00", r.val, "cached result should match")
+	s.w.client.(*redisFetcherMock).AssertNumberOfCalls(s.T(), "Do", 2)
+
+	run("set", "k00", "v01")
+	_, ok := s.c.getValue(dbKey(0, derivedKey([]string{"evalsha", testScriptSHA, "1", "k00"})))
+	s.False(ok, "writes to the script's keys should invalidate its result")
+}
+
+func TestScriptsBound(t *testing.T) {
+	sc := newScripts(nil)
+
+	first := sc.add("return 0")
+	for i := 1; i <= maxScriptBodies; i++ {
+		if i == maxScriptBodies {
+			// using a script keeps it around
+			sc.body(first)
+		}
+		sc.add("return " + strconv.Itoa(i))
+	}
+
+	if len(sc.bodies) != maxScriptBodies || sc.lru.Len() != maxScriptBodies {
+		t.Errorf("bodies should be bounded, got %d", len(sc.bodies))
+	}
+
+	if _, ok := sc.body(first); !ok {
+		t.Error("recently used bodies should be kept")
+	}
+
+	second := sha1.Sum([]byte("return 1"))
+	if _, ok := sc.body(hex.EncodeToString(second[:])); ok {
+		t.Error("the least recently used body should be forgotten")
+	}
+}
+
+func (s *SuiteWorker) TestDBRun() {
+	go s.w.run(s.ctx)
+
+	s.c.set(dbKey(0, "k00"), "v00")
+	s.c.set(dbKey(3, "k00"), "v03")
+	<-time.After(time.Millisecond * 5)
+
+	job := newJob(s.ctx, "k00")
+	job.db = 3
+	<-s.ws <- job
+
+	r := <-job.res
+	s.Equal("v03", r.body, "keys should be namespaced by database")
+
+	job = newCmdJob(s.ctx, "flushdb")
+	job.db = 3
+	<-s.ws <- job
+	<-job.res
+
+	s.Equal("", s.c.get(dbKey(3, "k00")), "FLUSHDB should clear the database's namespace")
+	s.Equal("v00", s.c.get(dbKey(0, "k00")), "FLUSHDB should keep the other databases")
+}
+
+func TestBackoff(t *testing.T) {
+	min := time.Millisecond
+	max := time.Millisecond * 8
+
+	if d := backoff(0, min, max); d != 0 {
+		t.Errorf("first attempt shouldn't wait, got %v", d)
+	}
+
+	for attempt := 1; attempt < 10; attempt++ {
+		if d := backoff(attempt, min, max); d < 0 || d > max {
+			t.Errorf("backoff for attempt %d should be within [0, %v], got %v", attempt, max, d)
+		}
+	}
+}
+
 func TestWorkerSuite(t *testing.T) {
 	suite.Run(t, new(SuiteWorker))
 }